@@ -0,0 +1,384 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type ColorMode byte
+
+const (
+	ColorDefault ColorMode = iota
+	// ColorBasic is one of the 8 colors of SGR 30-37 and 40-47, which terminals tend to show bright in bold text.
+	ColorBasic
+	// ColorBright is one of the 8 bright colors of SGR 90-97 and 100-107.
+	ColorBright
+	Color256
+	ColorRGB
+)
+
+// Color is a foreground or background color. The zero Color is the default color of the terminal.
+type Color struct {
+	Mode  ColorMode
+	Index byte
+	R     byte
+	G     byte
+	B     byte
+}
+
+// Validate returns an error for colors that can't be shown, like basic colors beyond the 8 there are.
+func (self Color) Validate() (err error) {
+	switch self.Mode {
+	case ColorDefault, Color256, ColorRGB:
+	case ColorBasic, ColorBright:
+		if self.Index > 7 {
+			err = fmt.Errorf("Color index %v is not one of the 8 basic colors", self.Index)
+		}
+	default:
+		err = fmt.Errorf("Unknown color mode %v", self.Mode)
+	}
+	return
+}
+
+// sgr returns the SGR parameters selecting the color, with base 30 for foreground and 40 for background.
+func (self Color) sgr(base int) string {
+	switch self.Mode {
+	case ColorBasic:
+		return fmt.Sprint(base + int(self.Index))
+	case ColorBright:
+		return fmt.Sprint(base + 60 + int(self.Index))
+	case Color256:
+		return fmt.Sprintf("%v;5;%v", base+8, self.Index)
+	case ColorRGB:
+		return fmt.Sprintf("%v;2;%v;%v;%v", base+8, self.R, self.G, self.B)
+	}
+	return fmt.Sprint(base + 9)
+}
+
+// Style is what SGR escape sequences can change about text. The zero Style is plain text.
+type Style struct {
+	Foreground    Color
+	Background    Color
+	Bold          bool
+	Faint         bool
+	Italic        bool
+	Underline     bool
+	Blink         bool
+	Inverse       bool
+	Strikethrough bool
+}
+
+// SGR returns the escape sequence that resets the terminal and then turns on this style.
+func (self Style) SGR() string {
+	params := []string{"0"}
+	for _, flag := range []struct {
+		on    bool
+		param string
+	}{
+		{self.Bold, "1"},
+		{self.Faint, "2"},
+		{self.Italic, "3"},
+		{self.Underline, "4"},
+		{self.Blink, "5"},
+		{self.Inverse, "7"},
+		{self.Strikethrough, "9"},
+	} {
+		if flag.on {
+			params = append(params, flag.param)
+		}
+	}
+	if self.Foreground.Mode != ColorDefault {
+		params = append(params, self.Foreground.sgr(30))
+	}
+	if self.Background.Mode != ColorDefault {
+		params = append(params, self.Background.sgr(40))
+	}
+	return "\x1b[" + strings.Join(params, ";") + "m"
+}
+
+func (self Style) Validate() (err error) {
+	if err = self.Foreground.Validate(); err != nil {
+		return
+	}
+	return self.Background.Validate()
+}
+
+// Overlay returns the style with the colors and attributes set in top laid over it.
+func (self Style) Overlay(top Style) Style {
+	if top.Foreground.Mode != ColorDefault {
+		self.Foreground = top.Foreground
+	}
+	if top.Background.Mode != ColorDefault {
+		self.Background = top.Background
+	}
+	self.Bold = self.Bold || top.Bold
+	self.Faint = self.Faint || top.Faint
+	self.Italic = self.Italic || top.Italic
+	self.Underline = self.Underline || top.Underline
+	self.Blink = self.Blink || top.Blink
+	self.Inverse = self.Inverse || top.Inverse
+	self.Strikethrough = self.Strikethrough || top.Strikethrough
+	return self
+}
+
+// extendedColor parses the 5;n or 2;r;g;b following 38 or 48, and returns how many parameters it used.
+func extendedColor(params []int) (result Color, used int) {
+	if len(params) > 1 && params[0] == 5 {
+		if params[1] >= 0 && params[1] < 256 {
+			result = Color{Mode: Color256, Index: byte(params[1])}
+		}
+		return result, 2
+	}
+	if len(params) > 3 && params[0] == 2 {
+		result = Color{Mode: ColorRGB, R: byte(params[1]), G: byte(params[2]), B: byte(params[3])}
+		return result, 4
+	}
+	return result, len(params)
+}
+
+// Apply changes the style like an SGR escape sequence with the given semicolon separated parameters would.
+func (self *Style) Apply(parameters string) {
+	params := []int{}
+	for _, part := range strings.Split(parameters, ";") {
+		n, _ := strconv.Atoi(part)
+		params = append(params, n)
+	}
+	for index := 0; index < len(params); index++ {
+		switch n := params[index]; {
+		case n == 0:
+			*self = Style{}
+		case n == 1:
+			self.Bold = true
+		case n == 2:
+			self.Faint = true
+		case n == 3:
+			self.Italic = true
+		case n == 4:
+			self.Underline = true
+		case n == 5:
+			self.Blink = true
+		case n == 7:
+			self.Inverse = true
+		case n == 9:
+			self.Strikethrough = true
+		case n == 22:
+			self.Bold, self.Faint = false, false
+		case n == 23:
+			self.Italic = false
+		case n == 24:
+			self.Underline = false
+		case n == 25:
+			self.Blink = false
+		case n == 27:
+			self.Inverse = false
+		case n == 29:
+			self.Strikethrough = false
+		case n >= 30 && n <= 37:
+			self.Foreground = Color{Mode: ColorBasic, Index: byte(n - 30)}
+		case n == 38:
+			extended, used := extendedColor(params[index+1:])
+			self.Foreground = extended
+			index += used
+		case n == 39:
+			self.Foreground = Color{}
+		case n >= 40 && n <= 47:
+			self.Background = Color{Mode: ColorBasic, Index: byte(n - 40)}
+		case n == 48:
+			extended, used := extendedColor(params[index+1:])
+			self.Background = extended
+			index += used
+		case n == 49:
+			self.Background = Color{}
+		case n >= 90 && n <= 97:
+			self.Foreground = Color{Mode: ColorBright, Index: byte(n - 90)}
+		case n >= 100 && n <= 107:
+			self.Background = Color{Mode: ColorBright, Index: byte(n - 100)}
+		}
+	}
+}
+
+// Span is text shown in one style.
+type Span struct {
+	Style Style
+	Text  string
+}
+
+// StyledText is text with the styling of its escape sequences kept apart from it, so that the plain text can be matched
+// and changed without losing the styling.
+type StyledText []Span
+
+// Plain returns the text without any styling. Offsets into it can be used with Slice.
+func (self StyledText) Plain() string {
+	result := &strings.Builder{}
+	for _, span := range self {
+		result.WriteString(span.Text)
+	}
+	return result.String()
+}
+
+// Slice returns the styled text between the byte offsets start and end of the plain text.
+func (self StyledText) Slice(start, end int) (result StyledText) {
+	offset := 0
+	for _, span := range self {
+		from, to := start-offset, end-offset
+		offset += len(span.Text)
+		if from < 0 {
+			from = 0
+		}
+		if to > len(span.Text) {
+			to = len(span.Text)
+		}
+		if from < to {
+			result = append(result, Span{Style: span.Style, Text: span.Text[from:to]})
+		}
+	}
+	return
+}
+
+// Restyle returns the text with style laid over the text between the byte offsets start and end of the plain text.
+func (self StyledText) Restyle(start, end int, style Style) (result StyledText) {
+	result = self.Slice(0, start)
+	for _, span := range self.Slice(start, end) {
+		result = append(result, Span{Style: span.Style.Overlay(style), Text: span.Text})
+	}
+	return append(result, self.Slice(end, len(self.Plain()))...)
+}
+
+// ANSI renders the text with SGR escape sequences, assuming the terminal starts with plain text and leaving it so.
+func (self StyledText) ANSI() string {
+	result := &strings.Builder{}
+	current := Style{}
+	for _, span := range self {
+		if span.Style != current {
+			result.WriteString(span.Style.SGR())
+			current = span.Style
+		}
+		result.WriteString(span.Text)
+	}
+	if current != (Style{}) {
+		result.WriteString(Style{}.SGR())
+	}
+	return result.String()
+}
+
+// maxEscapeLength is the longest incomplete escape sequence kept for the next call. A longer one is taken to be broken,
+// so that a server never ending a sequence can't hold back everything it sends after it.
+const maxEscapeLength = 4096
+
+// ANSIParser turns text with ANSI escape sequences into StyledText. It keeps the current style and any incomplete escape
+// sequence or character between calls, so that it can parse a stream chunk by chunk. Escape sequences other than SGR
+// are dropped, and incomplete ones longer than maxEscapeLength are shown as text without their escape. The zero
+// ANSIParser starts with plain text.
+type ANSIParser struct {
+	style   Style
+	pending []byte
+}
+
+func (self *ANSIParser) Parse(b []byte) (result StyledText) {
+	b = append(self.pending, b...)
+	self.pending = nil
+	text := []byte{}
+	flush := func() {
+		if len(text) == 0 {
+			return
+		}
+		result = append(result, Span{Style: self.style, Text: string(text)})
+		text = text[:0]
+	}
+	index := 0
+	for index < len(b) {
+		c := b[index]
+		if c != 0x1b {
+			text = append(text, c)
+			index++
+			continue
+		}
+		if index+1 >= len(b) {
+			break
+		}
+		if b[index+1] == ']' {
+			// operating system commands, like window titles, end with BEL or ESC \
+			end := index + 2
+			for end < len(b) && b[end] != 0x07 && !(b[end] == 0x1b && end+1 < len(b) && b[end+1] == '\\') {
+				end++
+			}
+			if end >= len(b) || (b[end] == 0x1b && end+1 >= len(b)) {
+				if len(b)-index <= maxEscapeLength {
+					break
+				}
+				index++
+				continue
+			}
+			if b[end] == 0x1b {
+				end++
+			}
+			index = end + 1
+			continue
+		}
+		if b[index+1] != '[' {
+			// other escape sequences, like charset selection, are intermediate bytes and a final byte
+			end := index + 1
+			for end < len(b) && b[end] >= 0x20 && b[end] <= 0x2f {
+				end++
+			}
+			if end >= len(b) {
+				if len(b)-index <= maxEscapeLength {
+					break
+				}
+				index++
+				continue
+			}
+			index = end + 1
+			continue
+		}
+		end := index + 2
+		for end < len(b) && b[end] >= 0x20 && b[end] <= 0x3f {
+			end++
+		}
+		if end >= len(b) {
+			if len(b)-index <= maxEscapeLength {
+				break
+			}
+			index++
+			continue
+		}
+		if b[end] == 'm' {
+			style := self.style
+			style.Apply(string(b[index+2 : end]))
+			if style != self.style {
+				flush()
+				self.style = style
+			}
+		}
+		index = end + 1
+	}
+	if index < len(b) {
+		self.pending = append([]byte{}, b[index:]...)
+	} else {
+		// keep a character split between chunks for the next call
+		for start := len(text) - 1; start >= 0 && start >= len(text)-utf8.UTFMax; start-- {
+			if utf8.RuneStart(text[start]) {
+				if !utf8.FullRune(text[start:]) {
+					self.pending = append([]byte{}, text[start:]...)
+					text = text[:start]
+				}
+				break
+			}
+		}
+	}
+	flush()
+	return
+}
+
+// StripANSI returns s without escape sequences.
+func StripANSI(s string) (result string) {
+	parser := &ANSIParser{}
+	result = parser.Parse([]byte(s)).Plain()
+	// there is no next call to complete a broken character at the end, so it is kept broken
+	if len(parser.pending) > 0 && parser.pending[0] != 0x1b {
+		result += string(parser.pending)
+	}
+	return
+}
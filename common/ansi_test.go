@@ -0,0 +1,84 @@
+package common
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var red = Style{Foreground: Color{Mode: ColorBasic, Index: 1}}
+
+func TestANSIParser(t *testing.T) {
+	parser := &ANSIParser{}
+	for _, test := range []struct {
+		input    string
+		expected StyledText
+	}{
+		{"plain\r\n", StyledText{{Text: "plain\r\n"}}},
+		{"\x1b[31mred\x1b[0m", StyledText{{Style: red, Text: "red"}}},
+		{"\x1b[1;31mbold", StyledText{{Style: Style{Bold: true, Foreground: red.Foreground}, Text: "bold"}}},
+		{"\x1b[", nil},
+		{"0m\x1b[38;5;196mcube\x1b[48;2;1;2;3mtrue", StyledText{
+			{Style: Style{Foreground: Color{Mode: Color256, Index: 196}}, Text: "cube"},
+			{Style: Style{Foreground: Color{Mode: Color256, Index: 196}, Background: Color{Mode: ColorRGB, R: 1, G: 2, B: 3}}, Text: "true"},
+		}},
+		{"\x1b[0;95;7mbright\x1b[27;39m", StyledText{{Style: Style{Foreground: Color{Mode: ColorBright, Index: 5}, Inverse: true}, Text: "bright"}}},
+		{"split \xc3", StyledText{{Text: "split "}}},
+		{"\xa5\x1b[2Jclear", StyledText{{Text: "åclear"}}},
+		{"\x1b(Bcharset\x1b]0;title\x07", StyledText{{Text: "charset"}}},
+		{"\x1b[31ma\x1b[31mb\x1b[0m", StyledText{{Style: red, Text: "ab"}}},
+	} {
+		if found := parser.Parse([]byte(test.input)); !reflect.DeepEqual(found, test.expected) {
+			t.Errorf("Wanted %+v for %#v, got %+v", test.expected, test.input, found)
+		}
+	}
+}
+
+func TestANSIParserUnterminated(t *testing.T) {
+	parser := &ANSIParser{}
+	if found := parser.Parse([]byte("before\x1b]0;never ending title")); !reflect.DeepEqual(found, StyledText{{Text: "before"}}) {
+		t.Fatalf("Wanted the title kept back, got %+v", found)
+	}
+	long := strings.Repeat("x", maxEscapeLength)
+	if found := parser.Parse([]byte(long)); !reflect.DeepEqual(found, StyledText{{Text: "]0;never ending title" + long}}) {
+		t.Fatalf("Wanted the broken title shown as text, got %+v", found)
+	}
+	if found := parser.Parse([]byte("\x1b[31mafter")); !reflect.DeepEqual(found, StyledText{{Style: red, Text: "after"}}) {
+		t.Fatalf("Wanted parsing to go on after the broken title, got %+v", found)
+	}
+	if found := parser.Parse([]byte("\x1b[" + strings.Repeat("1;", maxEscapeLength))); !reflect.DeepEqual(found, StyledText{{Style: red, Text: "[" + strings.Repeat("1;", maxEscapeLength)}}) {
+		t.Fatalf("Wanted the broken CSI shown as text, got %+v", found)
+	}
+}
+
+func TestStyledText(t *testing.T) {
+	text := (&ANSIParser{}).Parse([]byte("You see \x1b[1;32ma green dragon\x1b[0m here.\n"))
+	if plain := text.Plain(); plain != "You see a green dragon here.\n" {
+		t.Fatalf("Got %#v", plain)
+	}
+	if found := text.Slice(4, 14); !reflect.DeepEqual(found, StyledText{{Text: "see "}, {Style: Style{Bold: true, Foreground: Color{Mode: ColorBasic, Index: 2}}, Text: "a gree"}}) {
+		t.Errorf("Got %+v", found)
+	}
+	cut := append(text.Slice(0, 10), text.Slice(16, 29)...)
+	if found := cut.ANSI(); found != "You see \x1b[0;1;32ma dragon\x1b[0m here.\n" {
+		t.Errorf("Got %#v", found)
+	}
+	if found := (StyledText{{Style: red, Text: "red"}}).ANSI(); found != "\x1b[0;31mred\x1b[0m" {
+		t.Errorf("Got %#v", found)
+	}
+	if found := StripANSI("\x1b[31mHP:\x1b[0m 10 \xc3"); found != "HP: 10 \xc3" {
+		t.Errorf("Got %#v", found)
+	}
+}
+
+func TestFindMatchIndex(t *testing.T) {
+	interrupt := &ConsumptionInterrupt{Pattern: "gr[a-z]+"}
+	start, end, found, err := interrupt.FindMatchIndex("a green dragon")
+	if err != nil || !found || start != 2 || end != 7 {
+		t.Fatalf("Got %v, %v, %v, %v", start, end, found, err)
+	}
+	before, content, after, found, err := interrupt.FindMatch("a green dragon")
+	if err != nil || !found || before != "a " || content != "green" || after != " dragon" {
+		t.Fatalf("Got %#v, %#v, %#v, %v, %v", before, content, after, found, err)
+	}
+}
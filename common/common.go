@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"time"
 )
 
 var (
@@ -27,16 +28,84 @@ func init() {
 
 const (
 	ProxyTransmit                      = "ProxyTransmit"
+	ProxyTransmitNow                   = "ProxyTransmitNow"
+	ProxyCommandQueue                  = "ProxyCommandQueue"
+	ProxyFlushCommandQueue             = "ProxyFlushCommandQueue"
+	ProxyTelnetOptions                 = "ProxyTelnetOptions"
+	ProxyTransmitGMCP                  = "ProxyTransmitGMCP"
+	ProxyTransmitMSDP                  = "ProxyTransmitMSDP"
+	ProxyMSDP                          = "ProxyMSDP"
+	ProxyMSSP                          = "ProxyMSSP"
+	ProxyTLS                           = "ProxyTLS"
+	ProxyCharset                       = "ProxyCharset"
+	ProxySetCharset                    = "ProxySetCharset"
+	ProxyWindowSize                    = "ProxyWindowSize"
+	ProxyScrollback                    = "ProxyScrollback"
+	ProxyDeliveryStats                 = "ProxyDeliveryStats"
+	ProxyStatus                        = "ProxyStatus"
+	ProxyConnect                       = "ProxyConnect"
+	ProxyDisconnect                    = "ProxyDisconnect"
 	SubscriberTransmit                 = "SubscriberTransmit"
 	SubscriberReceive                  = "SubscriberReceive"
+	SubscriberLine                     = "SubscriberLine"
+	SubscriberEcho                     = "SubscriberEcho"
 	SubscriberLog                      = "SubscriberLog"
+	SubscriberGMCP                     = "SubscriberGMCP"
+	SubscriberMSDP                     = "SubscriberMSDP"
+	SubscriberMSSP                     = "SubscriberMSSP"
+	SubscriberConnected                = "SubscriberConnected"
+	SubscriberDisconnected             = "SubscriberDisconnected"
 	ConsumerConsume                    = "ConsumerConsume"
 	ConsumerInterruptConsumption       = "ConsumerInterruptConsumption"
+	ConsumerHighlight                  = "ConsumerHighlight"
+	ConsumerUnhighlight                = "ConsumerUnhighlight"
+	ConsumerHighlights                 = "ConsumerHighlights"
 	InterruptorInterruptedConsumption  = "InterruptorInterruptedConsumption"
 	InterruptorInterruptedTransmission = "InterruptorInterruptedTransmission"
 	ControllerInterruptTransmission    = "ControllerInterruptTransmission"
 )
 
+const (
+	DefaultSession = "default"
+)
+
+// Chunk is data received from or transmitted to the server of a session. An empty Session in a chunk sent to the
+// proxy means the default session. The proxy numbers all chunks in both directions with the same increasing Seq, and
+// delivers them to each consumer and subscriber in that order. Prompt means the server ended the chunk with GA or EOR.
+// Secret means the chunk was transmitted while the server had turned local echo off, typically because it was a
+// password, and the proxy replaces its Data with Redacted before anyone else sees it.
+type Chunk struct {
+	Session     string
+	Data        []byte
+	Seq         uint64
+	Time        time.Time
+	Transmitted bool
+	Prompt      bool
+	Secret      bool
+}
+
+const (
+	Redacted = "********"
+)
+
+// Redact returns the chunk with the data replaced if it is secret, keeping any line ending.
+func (self Chunk) Redact() Chunk {
+	if self.Secret {
+		data := []byte(Redacted)
+		if trimmed := bytes.TrimRight(self.Data, "\r\n"); len(trimmed) < len(self.Data) {
+			data = append(data, self.Data[len(trimmed):]...)
+		}
+		self.Data = data
+	}
+	return self
+}
+
+// EchoState tells whether the server of a session has turned local echo off, so input should be masked.
+type EchoState struct {
+	Session string
+	Masked  bool
+}
+
 type InterruptedTransmission struct {
 	Name  string
 	Match []string
@@ -96,12 +165,53 @@ func (self *ConsumptionInterrupt) Compiled() (result *regexp.Regexp, err error)
 }
 
 func (self *ConsumptionInterrupt) FindMatch(s string) (before, content, after string, found bool, err error) {
+	start, end, found, err := self.FindMatchIndex(s)
+	if found {
+		before, content, after = s[:start], s[start:end], s[end:]
+	}
+	return
+}
+
+// FindMatchIndex returns where in s the pattern matches, so that the match can be cut out of styled text with the same
+// plain text.
+func (self *ConsumptionInterrupt) FindMatchIndex(s string) (start, end int, found bool, err error) {
 	compiled, err := self.Compiled()
 	if err != nil {
 		return
 	}
-	if match := compiled.FindStringSubmatch(s); match != nil {
-		before, content, after, found = match[self.beforeGroup], match[self.contentGroup], match[self.afterGroup], true
+	if match := compiled.FindStringSubmatchIndex(s); match != nil {
+		start, end, found = match[2*self.contentGroup], match[2*self.contentGroup+1], true
+	}
+	return
+}
+
+// Highlight makes consumers show what Pattern matches in the plain text, or the whole line it matches in if WholeLine,
+// with Style laid over the style it already has. Highlights only change what is shown, not what scripts see.
+type Highlight struct {
+	Name      string
+	Pattern   string
+	Style     Style
+	WholeLine bool
+	compiled  *regexp.Regexp
+}
+
+func (self *Highlight) Compiled() (result *regexp.Regexp, err error) {
+	if self.compiled == nil {
+		if self.compiled, err = regexp.Compile(self.Pattern); err != nil {
+			return
+		}
+	}
+	result = self.compiled
+	return
+}
+
+// Validate returns an error if the pattern doesn't compile or the style can't be shown.
+func (self *Highlight) Validate() (err error) {
+	if _, err = self.Compiled(); err != nil {
+		return
+	}
+	if err = self.Style.Validate(); err != nil {
+		err = fmt.Errorf("Invalid style for highlight %#v: %v", self.Name, err)
 	}
 	return
 }
@@ -196,3 +306,102 @@ func (self *CompleteNode) completeHelper(toTraverse, traversed []byte) (result [
 func (self *CompleteNode) Complete(b []byte) (result []byte, found bool) {
 	return self.completeHelper(b, nil)
 }
+
+type TLSState struct {
+	Version     string
+	CipherSuite string
+	ServerName  string
+	Subject     string
+	Issuer      string
+	NotAfter    time.Time
+	Fingerprint string
+	Verified    bool
+}
+
+type ConnectionEvent struct {
+	Session      string
+	Addr         string
+	Time         time.Time
+	Attempt      int
+	Error        string
+	Reconnecting bool
+}
+
+const (
+	WindowSizeConsumer   = "consumer"
+	WindowSizeController = "controller"
+)
+
+// ScrollbackRequest asks for the last Lines lines, or the last Bytes bytes, received from the named session, or from
+// all sessions if Session is empty. If both Lines and Bytes are set, whichever limit is reached first applies.
+type ScrollbackRequest struct {
+	Session string
+	Lines   int
+	Bytes   int
+}
+
+const (
+	OverflowDropOldest     = "dropoldest"
+	OverflowDropSubscriber = "dropsubscriber"
+	OverflowBlock          = "block"
+)
+
+var OverflowPolicies = []string{
+	OverflowDropOldest,
+	OverflowDropSubscriber,
+	OverflowBlock,
+}
+
+// DeliveryStats describes the delivery queue the proxy keeps for a consumer or subscriber. Lag is how long the message
+// currently being delivered has been waiting.
+type DeliveryStats struct {
+	Service     string
+	Addr        string
+	Queued      int
+	Capacity    int
+	Delivered   int64
+	Dropped     int64
+	Failed      int64
+	Lag         time.Duration
+	LastLatency time.Duration
+	Removed     bool
+}
+
+// SessionStatus describes what a session of the proxy is doing. The times and byte counts are for the current
+// connection, and the bytes are counted on the wire, so before decompression and after compression.
+type SessionStatus struct {
+	Session        string
+	Addr           string
+	Connected      bool
+	Replaying      bool
+	ConnectedSince time.Time
+	BytesIn        int64
+	BytesOut       int64
+	QueuedCommands int
+	TelnetOptions  []TelnetOption
+	// TLS is nil unless the session is connected using TLS
+	TLS *TLSState
+}
+
+// Status describes the sessions of the proxy, and the consumers and subscribers it delivers to.
+type Status struct {
+	Sessions []SessionStatus
+	Clients  []DeliveryStats
+}
+
+// ConnectRequest asks the proxy to connect a session to Addr, or to reconnect it to where it was if Addr is empty.
+type ConnectRequest struct {
+	Session string
+	Addr    string
+}
+
+type SessionCharset struct {
+	Session string
+	Charset string
+}
+
+type WindowSize struct {
+	Source string
+	Width  int
+	Height int
+}
@@ -0,0 +1,20 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestChunkRedact(t *testing.T) {
+	for _, test := range []struct {
+		chunk    Chunk
+		expected string
+	}{
+		{Chunk{Data: []byte("look\n")}, "look\n"},
+		{Chunk{Data: []byte("hunter2\r\n"), Secret: true}, Redacted + "\r\n"},
+		{Chunk{Data: []byte("hunter2"), Secret: true}, Redacted},
+	} {
+		if found := string(test.chunk.Redact().Data); found != test.expected {
+			t.Fatalf("Wanted %#v, got %#v", test.expected, found)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+func init() {
+	// decoded JSON is sent as interface{} values over gob
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+type GMCPMessage struct {
+	Session string
+	Package string
+	Data    interface{}
+}
+
+func (self GMCPMessage) String() string {
+	return fmt.Sprintf("%v %v", self.Package, self.Data)
+}
+
+// Decode converts the already decoded Data into dst, which can be any type encoding/json can unmarshal into.
+func (self GMCPMessage) Decode(dst interface{}) (err error) {
+	b, err := json.Marshal(self.Data)
+	if err != nil {
+		return
+	}
+	return json.Unmarshal(b, dst)
+}
+
+func (self GMCPMessage) Bytes() (result []byte, err error) {
+	result = []byte(self.Package)
+	if self.Data != nil {
+		var b []byte
+		if b, err = json.Marshal(self.Data); err != nil {
+			return
+		}
+		result = append(append(result, ' '), b...)
+	}
+	return
+}
+
+// Matches returns whether the package of this message is pkg or a sub package of pkg. Package names are case insensitive.
+func (self GMCPMessage) Matches(pkg string) bool {
+	if len(self.Package) < len(pkg) || !bytes.EqualFold([]byte(self.Package[:len(pkg)]), []byte(pkg)) {
+		return false
+	}
+	return len(self.Package) == len(pkg) || self.Package[len(pkg)] == '.'
+}
+
+func ParseGMCP(b []byte) (result GMCPMessage, err error) {
+	b = bytes.TrimSpace(b)
+	if index := bytes.IndexAny(b, " \t\r\n"); index == -1 {
+		result.Package = string(b)
+	} else {
+		result.Package = string(b[:index])
+		if err = json.Unmarshal(bytes.TrimSpace(b[index:]), &result.Data); err != nil {
+			err = fmt.Errorf("Unable to parse GMCP %#v: %v", string(b), err)
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGMCP(t *testing.T) {
+	msg, err := ParseGMCP([]byte(`Char.Vitals {"hp": 10, "maxhp": 20}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Package != "Char.Vitals" || !reflect.DeepEqual(msg.Data, map[string]interface{}{"hp": 10.0, "maxhp": 20.0}) {
+		t.Fatalf("Wrong message %+v", msg)
+	}
+	vitals := struct {
+		HP    int
+		MaxHP int
+	}{}
+	if err = msg.Decode(&vitals); err != nil {
+		t.Fatal(err)
+	}
+	if vitals.HP != 10 || vitals.MaxHP != 20 {
+		t.Fatalf("Wrong vitals %+v", vitals)
+	}
+	if !msg.Matches("char") || !msg.Matches("Char.Vitals") || msg.Matches("Char.Vit") {
+		t.Fatalf("Wrong matching for %+v", msg)
+	}
+	if msg, err = ParseGMCP([]byte("Core.Ping")); err != nil || msg.Package != "Core.Ping" || msg.Data != nil {
+		t.Fatalf("Wrong message %+v, %v", msg, err)
+	}
+}
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"bytes"
+	"regexp"
+	"time"
+)
+
+// Line is a complete line received from a session, without the line ending, or a prompt, which is text the server
+// expects a response to without ending the line. Seq and Time are those of the chunk that completed it.
+type Line struct {
+	Session string
+	Text    string
+	Prompt  bool
+	Seq     uint64
+	Time    time.Time
+}
+
+// LineFramer reassembles chunks into lines. Incomplete lines are kept until the next chunk arrives, unless they end with
+// a GA or EOR (Chunk.Prompt) or match PromptPattern, in which case they are prompts.
+type LineFramer struct {
+	PromptPattern *regexp.Regexp
+	pending       []byte
+	last          Chunk
+}
+
+func (self *LineFramer) line(text []byte, prompt bool) Line {
+	return Line{
+		Session: self.last.Session,
+		Text:    string(bytes.TrimRight(text, "\r")),
+		Prompt:  prompt,
+		Seq:     self.last.Seq,
+		Time:    self.last.Time,
+	}
+}
+
+func (self *LineFramer) Frame(chunk Chunk) (result []Line) {
+	self.last = chunk
+	self.pending = append(self.pending, chunk.Data...)
+	for {
+		index := bytes.IndexByte(self.pending, '\n')
+		if index == -1 {
+			break
+		}
+		result = append(result, self.line(self.pending[:index], false))
+		self.pending = self.pending[index+1:]
+	}
+	if len(self.pending) > 0 && (chunk.Prompt || (self.PromptPattern != nil && self.PromptPattern.Match(self.pending))) {
+		result = append(result, self.line(self.pending, true))
+		self.pending = nil
+	}
+	if len(self.pending) == 0 {
+		self.pending = nil
+	}
+	return
+}
+
+// Pending returns whether there is an incomplete line waiting for more data.
+func (self *LineFramer) Pending() bool {
+	return len(self.pending) > 0
+}
+
+// Flush returns any incomplete line as a prompt, for when no more data has arrived for a while.
+func (self *LineFramer) Flush() (result []Line) {
+	if len(self.pending) > 0 {
+		result = append(result, self.line(self.pending, true))
+		self.pending = nil
+	}
+	return
+}
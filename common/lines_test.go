@@ -0,0 +1,48 @@
+package common
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func lineTexts(lines []Line) (result []string) {
+	for _, line := range lines {
+		if line.Prompt {
+			result = append(result, "PROMPT "+line.Text)
+		} else {
+			result = append(result, line.Text)
+		}
+	}
+	return
+}
+
+func TestLineFramer(t *testing.T) {
+	framer := &LineFramer{
+		PromptPattern: regexp.MustCompile(`^<\d+hp> $`),
+	}
+	for _, test := range []struct {
+		chunk    Chunk
+		expected []string
+	}{
+		{Chunk{Data: []byte("You see a dr")}, nil},
+		{Chunk{Data: []byte("agon.\r\nIt lo")}, []string{"You see a dragon."}},
+		{Chunk{Data: []byte("oks hungry.\r\n\r\n<10hp> ")}, []string{"It looks hungry.", "", "PROMPT <10hp> "}},
+		{Chunk{Data: []byte("Password: "), Prompt: true}, []string{"PROMPT Password: "}},
+		{Chunk{Prompt: true}, nil},
+		{Chunk{Data: []byte("More? ")}, nil},
+	} {
+		if found := lineTexts(framer.Frame(test.chunk)); !reflect.DeepEqual(found, test.expected) {
+			t.Fatalf("Wanted %#v for %#v, got %#v", test.expected, string(test.chunk.Data), found)
+		}
+	}
+	if !framer.Pending() {
+		t.Fatalf("Wanted pending line")
+	}
+	if found := lineTexts(framer.Flush()); !reflect.DeepEqual(found, []string{"PROMPT More? "}) {
+		t.Fatalf("Wanted flushed prompt, got %#v", found)
+	}
+	if framer.Pending() {
+		t.Fatalf("Wanted no pending line")
+	}
+}
@@ -0,0 +1,253 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+const (
+	msdpVar        byte = 1
+	msdpVal        byte = 2
+	msdpTableOpen  byte = 3
+	msdpTableClose byte = 4
+	msdpArrayOpen  byte = 5
+	msdpArrayClose byte = 6
+)
+
+type MSDPValueType int
+
+const (
+	MSDPString MSDPValueType = iota
+	MSDPTable
+	MSDPArray
+)
+
+type MSDPValue struct {
+	Type  MSDPValueType
+	Value string
+	Table map[string]MSDPValue
+	Array []MSDPValue
+}
+
+func MSDPStrings(s ...string) (result MSDPValue) {
+	if len(s) == 1 {
+		result.Value = s[0]
+		return
+	}
+	result.Type = MSDPArray
+	for _, v := range s {
+		result.Array = append(result.Array, MSDPValue{Value: v})
+	}
+	return
+}
+
+func (self MSDPValue) String() string {
+	buf := &bytes.Buffer{}
+	switch self.Type {
+	case MSDPString:
+		fmt.Fprintf(buf, "%#v", self.Value)
+	case MSDPArray:
+		fmt.Fprint(buf, "[")
+		for index, value := range self.Array {
+			if index > 0 {
+				fmt.Fprint(buf, ", ")
+			}
+			fmt.Fprint(buf, value.String())
+		}
+		fmt.Fprint(buf, "]")
+	case MSDPTable:
+		keys := []string{}
+		for key := range self.Table {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		fmt.Fprint(buf, "{")
+		for index, key := range keys {
+			if index > 0 {
+				fmt.Fprint(buf, ", ")
+			}
+			fmt.Fprintf(buf, "%#v: %v", key, self.Table[key].String())
+		}
+		fmt.Fprint(buf, "}")
+	}
+	return buf.String()
+}
+
+func (self MSDPValue) write(buf *bytes.Buffer) {
+	switch self.Type {
+	case MSDPString:
+		buf.WriteString(self.Value)
+	case MSDPArray:
+		buf.WriteByte(msdpArrayOpen)
+		for _, value := range self.Array {
+			buf.WriteByte(msdpVal)
+			value.write(buf)
+		}
+		buf.WriteByte(msdpArrayClose)
+	case MSDPTable:
+		buf.WriteByte(msdpTableOpen)
+		for key, value := range self.Table {
+			buf.WriteByte(msdpVar)
+			buf.WriteString(key)
+			buf.WriteByte(msdpVal)
+			value.write(buf)
+		}
+		buf.WriteByte(msdpTableClose)
+	}
+}
+
+type MSDPVariable struct {
+	Session string
+	Name    string
+	Value   MSDPValue
+}
+
+func (self MSDPVariable) String() string {
+	return fmt.Sprintf("%v=%v", self.Name, self.Value)
+}
+
+func (self MSDPVariable) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(msdpVar)
+	buf.WriteString(self.Name)
+	buf.WriteByte(msdpVal)
+	self.Value.write(buf)
+	return buf.Bytes()
+}
+
+type msdpParser struct {
+	b   []byte
+	pos int
+}
+
+func (self *msdpParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("Unable to parse MSDP %#v at %v: %v", string(self.b), self.pos, fmt.Sprintf(format, args...))
+}
+
+func (self *msdpParser) more() bool {
+	return self.pos < len(self.b)
+}
+
+func (self *msdpParser) peek() byte {
+	return self.b[self.pos]
+}
+
+func (self *msdpParser) text() string {
+	start := self.pos
+	for self.more() && self.peek() > msdpArrayClose {
+		self.pos++
+	}
+	return string(self.b[start:self.pos])
+}
+
+func (self *msdpParser) value() (result MSDPValue, err error) {
+	if !self.more() {
+		return
+	}
+	switch self.peek() {
+	case msdpTableOpen:
+		self.pos++
+		result.Type = MSDPTable
+		result.Table = map[string]MSDPValue{}
+		var variables []MSDPVariable
+		if variables, err = self.variables(msdpTableClose); err != nil {
+			return
+		}
+		for _, variable := range variables {
+			result.Table[variable.Name] = variable.Value
+		}
+	case msdpArrayOpen:
+		self.pos++
+		result.Type = MSDPArray
+		for self.more() && self.peek() != msdpArrayClose {
+			if self.peek() != msdpVal {
+				err = self.errorf("expected VAL, found %v", self.peek())
+				return
+			}
+			self.pos++
+			var value MSDPValue
+			if value, err = self.value(); err != nil {
+				return
+			}
+			result.Array = append(result.Array, value)
+		}
+		if !self.more() {
+			err = self.errorf("unterminated array")
+			return
+		}
+		self.pos++
+	default:
+		result.Value = self.text()
+	}
+	return
+}
+
+func (self *msdpParser) variables(closer byte) (result []MSDPVariable, err error) {
+	for self.more() {
+		if closer != 0 && self.peek() == closer {
+			self.pos++
+			return
+		}
+		if self.peek() != msdpVar {
+			err = self.errorf("expected VAR, found %v", self.peek())
+			return
+		}
+		self.pos++
+		variable := MSDPVariable{
+			Name: self.text(),
+		}
+		values := []MSDPValue{}
+		for self.more() && self.peek() == msdpVal {
+			self.pos++
+			var value MSDPValue
+			if value, err = self.value(); err != nil {
+				return
+			}
+			values = append(values, value)
+		}
+		// several VALs for one VAR is shorthand for an array
+		if len(values) == 1 {
+			variable.Value = values[0]
+		} else {
+			variable.Value = MSDPValue{
+				Type:  MSDPArray,
+				Array: values,
+			}
+		}
+		result = append(result, variable)
+	}
+	if closer != 0 {
+		err = self.errorf("unterminated table")
+	}
+	return
+}
+
+func ParseMSDP(b []byte) (result []MSDPVariable, err error) {
+	return (&msdpParser{b: b}).variables(0)
+}
+
+type MSSPStatus struct {
+	Session string
+	Values  map[string][]string
+}
+
+// ParseMSSP parses MSSP server status, where each variable can have several string values.
+func ParseMSSP(b []byte) (result map[string][]string, err error) {
+	result = map[string][]string{}
+	variables, err := ParseMSDP(b)
+	if err != nil {
+		return
+	}
+	for _, variable := range variables {
+		switch variable.Value.Type {
+		case MSDPString:
+			result[variable.Name] = append(result[variable.Name], variable.Value.Value)
+		case MSDPArray:
+			for _, value := range variable.Value.Array {
+				result[variable.Name] = append(result[variable.Name], value.Value)
+			}
+		}
+	}
+	return
+}
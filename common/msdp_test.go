@@ -0,0 +1,58 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMSDP(t *testing.T) {
+	b := []byte("\x01ROOM\x02\x03\x01VNUM\x026008\x01EXITS\x02\x03\x01n\x026011\x04\x04\x01AFFECTS\x02\x05\x02blind\x02deaf\x06\x01HEALTH\x0210")
+	variables, err := ParseMSDP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []MSDPVariable{
+		{
+			Name: "ROOM",
+			Value: MSDPValue{
+				Type: MSDPTable,
+				Table: map[string]MSDPValue{
+					"VNUM": {Value: "6008"},
+					"EXITS": {
+						Type: MSDPTable,
+						Table: map[string]MSDPValue{
+							"n": {Value: "6011"},
+						},
+					},
+				},
+			},
+		},
+		{Name: "AFFECTS", Value: MSDPStrings("blind", "deaf")},
+		{Name: "HEALTH", Value: MSDPStrings("10")},
+	}
+	if !reflect.DeepEqual(variables, expected) {
+		t.Fatalf("Wanted %v, got %v", expected, variables)
+	}
+	for _, variable := range expected {
+		if parsed, err := ParseMSDP(variable.Bytes()); err != nil || !reflect.DeepEqual(parsed, []MSDPVariable{variable}) {
+			t.Fatalf("Wanted %v, got %v, %v", variable, parsed, err)
+		}
+	}
+	if _, err = ParseMSDP([]byte("\x01ROOM\x02\x03\x01VNUM\x026008")); err == nil {
+		t.Fatalf("Wanted error for unterminated table")
+	}
+}
+
+func TestParseMSSP(t *testing.T) {
+	status, err := ParseMSSP([]byte("\x01NAME\x02Moxie MUD\x01PORT\x024000\x024001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"NAME": {"Moxie MUD"},
+		"PORT": {"4000", "4001"},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("Wanted %v, got %v", expected, status)
+	}
+}
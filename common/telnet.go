@@ -0,0 +1,250 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	TelnetSE   byte = 240
+	TelnetNOP  byte = 241
+	TelnetGA   byte = 249
+	TelnetSB   byte = 250
+	TelnetWILL byte = 251
+	TelnetWONT byte = 252
+	TelnetDO   byte = 253
+	TelnetDONT byte = 254
+	TelnetIAC  byte = 255
+	TelnetEOR  byte = 239
+)
+
+const (
+	TelnetOptionEcho            byte = 1
+	TelnetOptionSuppressGoAhead byte = 3
+	TelnetOptionTerminalType    byte = 24
+	TelnetOptionEndOfRecord     byte = 25
+	TelnetOptionNAWS            byte = 31
+	TelnetOptionCharset         byte = 42
+	TelnetOptionMSDP            byte = 69
+	TelnetOptionMSSP            byte = 70
+	TelnetOptionMCCP2           byte = 86
+	TelnetOptionMCCP3           byte = 87
+	TelnetOptionGMCP            byte = 201
+)
+
+var telnetOptionNames = map[byte]string{
+	TelnetOptionEcho:            "ECHO",
+	TelnetOptionSuppressGoAhead: "SGA",
+	TelnetOptionTerminalType:    "TTYPE",
+	TelnetOptionEndOfRecord:     "EOR",
+	TelnetOptionNAWS:            "NAWS",
+	TelnetOptionCharset:         "CHARSET",
+	TelnetOptionMSDP:            "MSDP",
+	TelnetOptionMSSP:            "MSSP",
+	TelnetOptionMCCP2:           "MCCP2",
+	TelnetOptionMCCP3:           "MCCP3",
+	TelnetOptionGMCP:            "GMCP",
+}
+
+func TelnetOptionName(option byte) string {
+	if name, found := telnetOptionNames[option]; found {
+		return name
+	}
+	return fmt.Sprint(option)
+}
+
+func TelnetVerbName(verb byte) string {
+	switch verb {
+	case TelnetWILL:
+		return "WILL"
+	case TelnetWONT:
+		return "WONT"
+	case TelnetDO:
+		return "DO"
+	case TelnetDONT:
+		return "DONT"
+	case TelnetGA:
+		return "GA"
+	case TelnetEOR:
+		return "EOR"
+	case TelnetNOP:
+		return "NOP"
+	}
+	return fmt.Sprint(verb)
+}
+
+// TelnetOption is the negotiated state of a single option. Local means we agreed to perform it (we sent WILL),
+// Remote means the other side agreed to perform it (we sent DO).
+type TelnetOption struct {
+	Code   byte
+	Name   string
+	Local  bool
+	Remote bool
+}
+
+func (self TelnetOption) String() string {
+	return fmt.Sprintf("%v(local: %v, remote: %v)", self.Name, self.Local, self.Remote)
+}
+
+type TelnetEventType int
+
+const (
+	TelnetText TelnetEventType = iota
+	TelnetCommand
+	TelnetNegotiation
+	TelnetSubnegotiation
+)
+
+// TelnetEvent is either a run of plain text (Data), a bare command (Verb, like GA or EOR), a negotiation (Verb and Option)
+// or a subnegotiation (Option and the unescaped payload in Data).
+type TelnetEvent struct {
+	Type   TelnetEventType
+	Verb   byte
+	Option byte
+	Data   []byte
+}
+
+const (
+	telnetData = iota
+	telnetIAC
+	telnetVerb
+	telnetSB
+	telnetSBData
+	telnetSBIAC
+)
+
+// maxSubnegotiationLength is the largest subnegotiation payload kept. Longer ones are dropped, so that a server never
+// ending one can't make the parser hold on to everything it sends.
+const maxSubnegotiationLength = 1 << 20
+
+// TelnetParser splits a telnet byte stream into events. It keeps its state between calls, so sequences split across
+// reads are handled. Parsing stops right after an MCCP2 start, since the rest of the stream is compressed, and consumed
+// tells how much of b was used.
+type TelnetParser struct {
+	state   int
+	verb    byte
+	option  byte
+	sub     []byte
+	dropped bool
+	lastCR  bool
+}
+
+func (self *TelnetParser) Parse(b []byte) (result []TelnetEvent, consumed int) {
+	text := &bytes.Buffer{}
+	flush := func() {
+		if text.Len() > 0 {
+			result = append(result, TelnetEvent{
+				Type: TelnetText,
+				Data: append([]byte{}, text.Bytes()...),
+			})
+			text.Reset()
+		}
+	}
+	for index, c := range b {
+		switch self.state {
+		case telnetData:
+			if c == TelnetIAC {
+				self.state = telnetIAC
+			} else if c == 0 && self.lastCR {
+				// CR NUL is how NVT sends a bare carriage return
+			} else {
+				text.WriteByte(c)
+			}
+			self.lastCR = c == '\r'
+		case telnetIAC:
+			switch c {
+			case TelnetIAC:
+				text.WriteByte(c)
+				self.state = telnetData
+			case TelnetWILL, TelnetWONT, TelnetDO, TelnetDONT:
+				self.verb = c
+				self.state = telnetVerb
+			case TelnetSB:
+				self.state = telnetSB
+			default:
+				flush()
+				result = append(result, TelnetEvent{
+					Type: TelnetCommand,
+					Verb: c,
+				})
+				self.state = telnetData
+			}
+		case telnetVerb:
+			flush()
+			result = append(result, TelnetEvent{
+				Type:   TelnetNegotiation,
+				Verb:   self.verb,
+				Option: c,
+			})
+			self.state = telnetData
+		case telnetSB:
+			self.option = c
+			self.sub = nil
+			self.dropped = false
+			self.state = telnetSBData
+		case telnetSBData:
+			if c == TelnetIAC {
+				self.state = telnetSBIAC
+			} else {
+				self.appendSub(c)
+			}
+		case telnetSBIAC:
+			switch c {
+			case TelnetSE:
+				flush()
+				if !self.dropped {
+					result = append(result, TelnetEvent{
+						Type:   TelnetSubnegotiation,
+						Option: self.option,
+						Data:   self.sub,
+					})
+				}
+				self.sub = nil
+				self.state = telnetData
+				if self.option == TelnetOptionMCCP2 {
+					consumed = index + 1
+					return
+				}
+			case TelnetIAC:
+				self.appendSub(c)
+				self.state = telnetSBData
+			default:
+				// broken subnegotiation, drop it and treat this as a fresh command
+				self.sub = nil
+				self.state = telnetIAC
+				flush()
+				events, _ := self.Parse([]byte{c})
+				result = append(result, events...)
+			}
+		}
+	}
+	flush()
+	consumed = len(b)
+	return
+}
+
+func (self *TelnetParser) appendSub(c byte) {
+	if len(self.sub) >= maxSubnegotiationLength {
+		self.sub, self.dropped = nil, true
+	}
+	if !self.dropped {
+		self.sub = append(self.sub, c)
+	}
+}
+
+func TelnetEscape(b []byte) []byte {
+	if bytes.IndexByte(b, TelnetIAC) == -1 {
+		return b
+	}
+	return bytes.Replace(b, []byte{TelnetIAC}, []byte{TelnetIAC, TelnetIAC}, -1)
+}
+
+func TelnetNegotiate(verb, option byte) []byte {
+	return []byte{TelnetIAC, verb, option}
+}
+
+func TelnetSubnegotiate(option byte, data []byte) (result []byte) {
+	result = append([]byte{TelnetIAC, TelnetSB, option}, TelnetEscape(data)...)
+	result = append(result, TelnetIAC, TelnetSE)
+	return
+}
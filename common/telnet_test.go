@@ -0,0 +1,74 @@
+package common
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTelnetParser(t *testing.T) {
+	parser := &TelnetParser{}
+	events, _ := parser.Parse([]byte{'h', 'i', TelnetIAC, TelnetWILL, TelnetOptionEcho, 'x', TelnetIAC, TelnetIAC, TelnetIAC, TelnetGA})
+	assertEvents(t, events, []TelnetEvent{
+		{Type: TelnetText, Data: []byte("hi")},
+		{Type: TelnetNegotiation, Verb: TelnetWILL, Option: TelnetOptionEcho},
+		{Type: TelnetText, Data: []byte{'x', TelnetIAC}},
+		{Type: TelnetCommand, Verb: TelnetGA},
+	})
+	events, _ = parser.Parse([]byte{'a', TelnetIAC, TelnetSB, TelnetOptionTerminalType, 1, TelnetIAC})
+	assertEvents(t, events, []TelnetEvent{
+		{Type: TelnetText, Data: []byte("a")},
+	})
+	events, _ = parser.Parse([]byte{TelnetIAC, 2, TelnetIAC, TelnetSE, '\r', 0, 'b'})
+	assertEvents(t, events, []TelnetEvent{
+		{Type: TelnetSubnegotiation, Option: TelnetOptionTerminalType, Data: []byte{1, TelnetIAC, 2}},
+		{Type: TelnetText, Data: []byte("\rb")},
+	})
+}
+
+func TestTelnetParserCompression(t *testing.T) {
+	parser := &TelnetParser{}
+	b := []byte{'a', TelnetIAC, TelnetSB, TelnetOptionMCCP2, TelnetIAC, TelnetSE, 0x78, 0x9c}
+	events, consumed := parser.Parse(b)
+	assertEvents(t, events, []TelnetEvent{
+		{Type: TelnetText, Data: []byte("a")},
+		{Type: TelnetSubnegotiation, Option: TelnetOptionMCCP2},
+	})
+	if consumed != 6 {
+		t.Fatalf("Wanted 6 consumed bytes, got %v", consumed)
+	}
+}
+
+func TestTelnetParserLongSubnegotiation(t *testing.T) {
+	parser := &TelnetParser{}
+	events, _ := parser.Parse([]byte{TelnetIAC, TelnetSB, TelnetOptionGMCP})
+	assertEvents(t, events, nil)
+	long := bytes.Repeat([]byte{'x'}, maxSubnegotiationLength)
+	events, _ = parser.Parse(long)
+	assertEvents(t, events, nil)
+	if len(parser.sub) != maxSubnegotiationLength {
+		t.Fatalf("Wanted the payload kept up to the limit, got %v bytes", len(parser.sub))
+	}
+	events, _ = parser.Parse([]byte("more"))
+	assertEvents(t, events, nil)
+	if len(parser.sub) != 0 {
+		t.Fatalf("Wanted the payload dropped beyond the limit, got %v bytes", len(parser.sub))
+	}
+	events, _ = parser.Parse([]byte{TelnetIAC, TelnetSE, 'o', 'k', TelnetIAC, TelnetSB, TelnetOptionGMCP, 'a', TelnetIAC, TelnetSE})
+	assertEvents(t, events, []TelnetEvent{
+		{Type: TelnetText, Data: []byte("ok")},
+		{Type: TelnetSubnegotiation, Option: TelnetOptionGMCP, Data: []byte("a")},
+	})
+}
+
+func TestTelnetEscape(t *testing.T) {
+	if got := TelnetSubnegotiate(TelnetOptionNAWS, []byte{0, TelnetIAC}); !reflect.DeepEqual(got, []byte{TelnetIAC, TelnetSB, TelnetOptionNAWS, 0, TelnetIAC, TelnetIAC, TelnetIAC, TelnetSE}) {
+		t.Fatalf("Wrong subnegotiation %v", got)
+	}
+}
+
+func assertEvents(t *testing.T, got, expected []TelnetEvent) {
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Wanted %+v, got %+v", expected, got)
+	}
+}
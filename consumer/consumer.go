@@ -3,35 +3,148 @@ package consumer
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"net/rpc"
-	"sync"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/zond/mdnsrpc"
 	"github.com/zond/moxie/common"
+	"github.com/zond/moxie/metrics"
+	"golang.org/x/term"
 )
 
 type Consumer struct {
-	client     *rpc.Client
-	stream     chan []byte
-	interrupts map[string]*common.ConsumptionInterrupt
-	lock       *sync.RWMutex
+	*Interrupts
+	*Highlights
+	dir      string
+	client   *rpc.Client
+	session  string
+	replay   common.ScrollbackRequest
+	replayed common.Chunk
+	stream   chan common.Chunk
+	parser   common.ANSIParser
+	screen   *screen
+	// pending is the unfinished last line, kept so that highlights see it whole once finished
+	pending common.StyledText
+	out     io.Writer
+	metrics *metrics.Registry
 }
 
-func New() *Consumer {
-	return &Consumer{
-		stream:     make(chan []byte),
-		interrupts: map[string]*common.ConsumptionInterrupt{},
-		lock:       &sync.RWMutex{},
+func New() (result *Consumer) {
+	result = &Consumer{
+		Highlights: NewHighlights(),
+		stream:     make(chan common.Chunk),
+		out:        os.Stdout,
 	}
+	result.Interrupts = NewInterrupts(func(s string) {
+		result.Log(s, nil)
+	})
+	return
+}
+
+// Dir makes the consumer keep its highlights in d.
+func (self *Consumer) Dir(d string) *Consumer {
+	self.dir = d
+	return self
+}
+
+// Session makes the consumer show only the output of the named session, instead of all sessions.
+func (self *Consumer) Session(name string) *Consumer {
+	self.session = name
+	return self
+}
+
+// Replay makes the consumer start by showing the last lines or bytes received by the proxy before it attached.
+func (self *Consumer) Replay(lines, bytes int) *Consumer {
+	self.replay.Lines = lines
+	self.replay.Bytes = bytes
+	return self
+}
+
+// Metrics makes the consumer record what it does in registry.
+func (self *Consumer) Metrics(registry *metrics.Registry) *Consumer {
+	self.metrics = registry
+	self.Interrupts.Metrics(registry)
+	return self
+}
+
+// Fullscreen makes the consumer show the output in a full screen view keeping the last lines lines, which can be paged
+// and searched, instead of printing it to the terminal. 0 lines turns the view off.
+func (self *Consumer) Fullscreen(lines int) *Consumer {
+	self.screen = nil
+	if lines > 0 {
+		self.screen = newScreen(lines, self.Highlights)
+	}
+	return self
+}
+
+// show prints the finished lines of text with highlights applied, and keeps any unfinished last line for later, unless
+// the full screen view shows the text.
+func (self *Consumer) show(text common.StyledText) {
+	if self.screen != nil {
+		self.screen.add(text)
+		return
+	}
+	text = append(append(common.StyledText{}, self.pending...), text...)
+	plain := text.Plain()
+	finished := strings.LastIndexByte(plain, '\n') + 1
+	self.pending = text.Slice(finished, len(plain))
+	if finished > 0 {
+		fmt.Fprint(self.out, self.Apply(text.Slice(0, finished)).ANSI())
+	}
+}
+
+// flush prints the unfinished last line kept by show, for when no more of it is coming soon, like after a prompt.
+func (self *Consumer) flush() {
+	if len(self.pending) > 0 {
+		fmt.Fprint(self.out, self.Apply(self.pending).ANSI())
+		self.pending = nil
+	}
+}
+
+func (self *Consumer) replayScrollback() (err error) {
+	if self.replay.Lines <= 0 && self.replay.Bytes <= 0 {
+		return
+	}
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	request := self.replay
+	request.Session = self.session
+	chunks := []common.Chunk{}
+	if err = self.metrics.Call(client, common.ProxyScrollback, request, &chunks); err != nil {
+		return
+	}
+	for _, chunk := range chunks {
+		self.show(self.parser.Parse(chunk.Data))
+		self.replayed = chunk
+	}
+	return
 }
 
 func (self *Consumer) Publish(unused struct{}, unused2 *struct{}) (err error) {
+	if self.dir != "" {
+		if err = self.Load(self.dir); err != nil {
+			return
+		}
+	}
 	_, err = mdnsrpc.Publish(common.Consumer, self)
 	if err != nil {
 		return
 	}
+	// replay after publishing, so that nothing is missed, and skip the replayed chunks when they arrive
+	if err = self.replayScrollback(); err != nil {
+		self.Log(fmt.Sprintf("Unable to replay scrollback: %v", err), nil)
+	}
+	go self.reportWindowSize()
+	if self.screen != nil {
+		go self.receive()
+		return self.screen.run()
+	}
 	if err = self.receive(); err != nil {
 		return
 	}
@@ -47,7 +160,7 @@ func (self *Consumer) Log(s string, unused *struct{}) (err error) {
 		log.Printf("%v", err.Error())
 	} else {
 		for _, client := range loggers {
-			if err := client.Call(common.SubscriberLog, s, nil); err != nil {
+			if err := self.metrics.Call(client, common.SubscriberLog, s, nil); err != nil {
 				log.Printf("%v", err.Error())
 			}
 		}
@@ -55,52 +168,29 @@ func (self *Consumer) Log(s string, unused *struct{}) (err error) {
 	return
 }
 
-func (self *Consumer) checkInterrupts(buf *bytes.Buffer) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
-	for name, interrupt := range self.interrupts {
-		before, content, after, found, err := interrupt.FindMatch(buf.String())
-		if err != nil {
-			self.Log(fmt.Sprintf("ERROR while checking interrupt %+v: %v", interrupt, err), nil)
-			delete(self.interrupts, name)
-		} else if found {
-			client, err := mdnsrpc.Connect(interrupt.Addr)
-			if err != nil {
-				self.Log(fmt.Sprintf("ERROR while finding client for interrupt %+v: %v", interrupt, err), nil)
-				delete(self.interrupts, name)
-			} else {
-				if err := client.Call(common.InterruptorInterruptedConsumption, common.InterruptedConsumption{
-					Name:    name,
-					Content: content,
-				}, nil); err != nil {
-					self.Log(fmt.Sprintf("ERROR while calling client for interrupt %+v: %v", interrupt, err), nil)
-					delete(self.interrupts, name)
+// reportWindowSize polls the size of the terminal, since there is no portable way to get notified when it changes.
+func (self *Consumer) reportWindowSize() {
+	last := common.WindowSize{}
+	for {
+		width, height, err := term.GetSize(int(os.Stdout.Fd()))
+		if err == nil && (width != last.Width || height != last.Height) {
+			size := common.WindowSize{
+				Source: common.WindowSizeConsumer,
+				Width:  width,
+				Height: height,
+			}
+			if client, err := mdnsrpc.LookupOne(common.Proxy); err == nil {
+				if err = self.metrics.Call(client, common.ProxyWindowSize, size, nil); err != nil {
+					self.Log(err.Error(), nil)
 				} else {
-					if interrupt.Times != 0 {
-						interrupt.Times -= 1
-						if interrupt.Times == 0 {
-							delete(self.interrupts, name)
-						}
-					}
-					buf.Reset()
-					buf.WriteString(before)
-					buf.WriteString(after)
+					last = size
 				}
 			}
 		}
+		time.Sleep(time.Second)
 	}
 }
 
-func (self *Consumer) ConsumerInterruptConsumption(interrupt common.ConsumptionInterrupt, unused *struct{}) (err error) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
-	if _, err = interrupt.Compiled(); err != nil {
-		return
-	}
-	self.interrupts[interrupt.Name] = &interrupt
-	return
-}
-
 func (self *Consumer) receive() (err error) {
 	buf := &bytes.Buffer{}
 	for {
@@ -108,8 +198,12 @@ func (self *Consumer) receive() (err error) {
 		buf.Reset()
 		for !timedOut {
 			select {
-			case b := <-self.stream:
-				if _, err = buf.Write(b); err != nil {
+			case chunk := <-self.stream:
+				// spilled scrollback can be older than a restart of the proxy, so only chunks that are not newer count
+				if chunk.Seq <= self.replayed.Seq && !chunk.Time.After(self.replayed.Time) {
+					continue
+				}
+				if _, err = buf.Write(chunk.Data); err != nil {
 					return
 				}
 			case <-time.After(time.Second / 10):
@@ -117,14 +211,19 @@ func (self *Consumer) receive() (err error) {
 			}
 		}
 		if buf.Len() > 0 {
-			self.checkInterrupts(buf)
+			self.show(self.Check(self.parser.Parse(buf.Bytes())))
+		} else {
+			self.flush()
 		}
-		fmt.Print(buf.String())
 	}
 	return
 }
 
-func (self *Consumer) ConsumerConsume(b []byte, unused *struct{}) (err error) {
-	self.stream <- b
+func (self *Consumer) ConsumerConsume(chunk common.Chunk, unused *struct{}) (err error) {
+	if self.session != "" && chunk.Session != self.session {
+		return
+	}
+	self.metrics.CountChunk(chunk)
+	self.stream <- chunk
 	return
 }
@@ -0,0 +1,35 @@
+package consumer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/zond/moxie/common"
+)
+
+func TestShowHighlightsWholeLines(t *testing.T) {
+	consumer := New()
+	out := &bytes.Buffer{}
+	consumer.out = out
+	bold := common.Style{Bold: true}
+	if err := consumer.ConsumerHighlight(common.Highlight{Name: "tells", Pattern: "tells you", Style: bold, WholeLine: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	consumer.show(common.StyledText{{Text: "Hi.\nBob te"}})
+	if out.String() != "Hi.\n" {
+		t.Fatalf("Wanted only the finished line shown, got %q", out.String())
+	}
+	consumer.show(common.StyledText{{Text: "lls you hello\nhp> "}})
+	expected := "Hi.\n" + consumer.Apply(common.StyledText{{Text: "Bob tells you hello\n"}}).ANSI()
+	if out.String() != expected {
+		t.Fatalf("Wanted the line split across chunks highlighted, got %q", out.String())
+	}
+	consumer.flush()
+	if expected += "hp> "; out.String() != expected {
+		t.Fatalf("Wanted the prompt shown when flushed, got %q", out.String())
+	}
+	consumer.flush()
+	if out.String() != expected {
+		t.Fatalf("Wanted nothing more shown, got %q", out.String())
+	}
+}
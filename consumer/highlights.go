@@ -0,0 +1,153 @@
+package consumer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/zond/moxie/common"
+)
+
+const highlightsFile = "highlights.json"
+
+// Highlights are the highlight rules of a consumer, saved in a directory so that they survive restarts. Anything
+// published as a consumer can embed it to serve ConsumerHighlight, ConsumerUnhighlight and ConsumerHighlights.
+type Highlights struct {
+	path       string
+	highlights []*common.Highlight
+	lock       *sync.RWMutex
+}
+
+func NewHighlights() *Highlights {
+	return &Highlights{
+		lock: &sync.RWMutex{},
+	}
+}
+
+// Load makes the highlights saved in dir, and saves them there when they change.
+func (self *Highlights) Load(dir string) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.path = filepath.Join(dir, highlightsFile)
+	self.highlights = nil
+	b, err := os.ReadFile(self.path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	loaded := []*common.Highlight{}
+	if err = json.Unmarshal(b, &loaded); err != nil {
+		err = fmt.Errorf("Unable to read %v: %v", self.path, err)
+		return
+	}
+	for _, highlight := range loaded {
+		if err = highlight.Validate(); err != nil {
+			err = fmt.Errorf("Unable to read %v: %v", self.path, err)
+			return
+		}
+	}
+	self.highlights = loaded
+	return
+}
+
+// save writes a new file and renames it over the old one, so that no other process loads half of it. Callers must hold
+// the lock.
+func (self *Highlights) save() (err error) {
+	if self.path == "" {
+		return
+	}
+	b, err := json.MarshalIndent(self.highlights, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(self.path), 0700); err != nil {
+		return
+	}
+	tmp := self.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0600); err != nil {
+		return
+	}
+	return os.Rename(tmp, self.path)
+}
+
+// ConsumerHighlight adds the highlight, or replaces the one with the same name. Later highlights are laid over earlier
+// ones.
+func (self *Highlights) ConsumerHighlight(highlight common.Highlight, unused *struct{}) (err error) {
+	if err = highlight.Validate(); err != nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	replaced := false
+	for index, existing := range self.highlights {
+		if existing.Name == highlight.Name {
+			self.highlights[index] = &highlight
+			replaced = true
+		}
+	}
+	if !replaced {
+		self.highlights = append(self.highlights, &highlight)
+	}
+	return self.save()
+}
+
+func (self *Highlights) ConsumerUnhighlight(name string, unused *struct{}) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	kept := []*common.Highlight{}
+	for _, highlight := range self.highlights {
+		if highlight.Name != name {
+			kept = append(kept, highlight)
+		}
+	}
+	if len(kept) == len(self.highlights) {
+		err = fmt.Errorf("No highlight named %#v", name)
+		return
+	}
+	self.highlights = kept
+	return self.save()
+}
+
+func (self *Highlights) ConsumerHighlights(unused struct{}, result *[]common.Highlight) (err error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	*result = nil
+	for _, highlight := range self.highlights {
+		*result = append(*result, *highlight)
+	}
+	return
+}
+
+// Apply returns text with the highlights laid over it, for showing it.
+func (self *Highlights) Apply(text common.StyledText) common.StyledText {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if len(self.highlights) == 0 {
+		return text
+	}
+	plain := text.Plain()
+	for _, highlight := range self.highlights {
+		compiled, err := highlight.Compiled()
+		if err != nil {
+			continue
+		}
+		for _, match := range compiled.FindAllStringIndex(plain, -1) {
+			start, end := match[0], match[1]
+			if highlight.WholeLine {
+				start = strings.LastIndexByte(plain[:start], '\n') + 1
+				if index := strings.IndexByte(plain[end:], '\n'); index == -1 {
+					end = len(plain)
+				} else {
+					end += index
+				}
+			}
+			text = text.Restyle(start, end, highlight.Style)
+		}
+	}
+	return text
+}
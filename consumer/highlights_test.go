@@ -0,0 +1,96 @@
+package consumer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zond/moxie/common"
+)
+
+func TestHighlights(t *testing.T) {
+	dir := t.TempDir()
+	highlights := NewHighlights()
+	if err := highlights.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	yellow := common.Style{Foreground: common.Color{Mode: common.ColorBasic, Index: 3}}
+	bold := common.Style{Bold: true}
+	for _, highlight := range []common.Highlight{
+		{Name: "tells", Pattern: "tells you", Style: yellow, WholeLine: true},
+		{Name: "names", Pattern: "Bob", Style: bold},
+		{Name: "broken", Pattern: "("},
+	} {
+		err := highlights.ConsumerHighlight(highlight, nil)
+		if (err != nil) != (highlight.Name == "broken") {
+			t.Fatalf("Got %v for %+v", err, highlight)
+		}
+	}
+	red := common.Style{Foreground: common.Color{Mode: common.ColorBasic, Index: 1}}
+	text := common.StyledText{{Text: "Hi.\nBob "}, {Style: red, Text: "tells you"}, {Text: " hello\nBye.\n"}}
+	expected := common.StyledText{
+		{Text: "Hi.\n"},
+		{Style: yellow.Overlay(bold), Text: "Bob"},
+		{Style: yellow, Text: " "},
+		{Style: yellow, Text: "tells you"},
+		{Style: yellow, Text: " hello"},
+		{Text: "\nBye.\n"},
+	}
+	if found := highlights.Apply(text); !reflect.DeepEqual(found, expected) {
+		t.Fatalf("Wanted %+v, got %+v", expected, found)
+	}
+	if text.Plain() != "Hi.\nBob tells you hello\nBye.\n" {
+		t.Fatalf("Changed the original text to %+v", text)
+	}
+
+	loaded := NewHighlights()
+	if err := loaded.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	found := []common.Highlight{}
+	if err := loaded.ConsumerHighlights(struct{}{}, &found); err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].Name != "tells" || found[1].Name != "names" || found[0].Style != yellow || !found[0].WholeLine {
+		t.Fatalf("Wanted the saved highlights, got %+v", found)
+	}
+	if err := loaded.ConsumerUnhighlight("tells", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.ConsumerUnhighlight("tells", nil); err == nil {
+		t.Fatal("Wanted an error for a missing highlight")
+	}
+	if err := highlights.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	if found := highlights.Apply(text); !reflect.DeepEqual(found, common.StyledText{{Text: "Hi.\n"}, {Style: bold, Text: "Bob"}, {Text: " "}, {Style: red, Text: "tells you"}, {Text: " hello\nBye.\n"}}) {
+		t.Fatalf("Got %+v", found)
+	}
+}
+
+func TestInvalidHighlights(t *testing.T) {
+	dir := t.TempDir()
+	highlights := NewHighlights()
+	if err := highlights.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, style := range []common.Style{
+		{Foreground: common.Color{Mode: common.ColorBasic, Index: 8}},
+		{Background: common.Color{Mode: common.ColorBright, Index: 255}},
+		{Foreground: common.Color{Mode: common.ColorRGB + 1}},
+	} {
+		if err := highlights.ConsumerHighlight(common.Highlight{Name: "broken", Pattern: "x", Style: style}, nil); err == nil {
+			t.Errorf("Wanted an error for %+v", style)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, highlightsFile), []byte(`[{"Name":"broken","Pattern":"x","Style":{"Foreground":{"Mode":1,"Index":9}}}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := highlights.Load(dir); err == nil {
+		t.Fatal("Wanted an error for a saved highlight with an invalid style")
+	}
+	if found := highlights.Apply(common.StyledText{{Text: "x"}}); !reflect.DeepEqual(found, common.StyledText{{Text: "x"}}) {
+		t.Fatalf("Wanted no highlights after failing to load, got %+v", found)
+	}
+}
@@ -0,0 +1,81 @@
+package consumer
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/zond/mdnsrpc"
+	"github.com/zond/moxie/common"
+	"github.com/zond/moxie/metrics"
+)
+
+// Interrupts are the consumption interrupts registered by scripts. Anything published as a consumer can embed it to
+// serve ConsumerInterruptConsumption.
+type Interrupts struct {
+	interrupts map[string]*common.ConsumptionInterrupt
+	log        func(string)
+	metrics    *metrics.Registry
+	lock       *sync.Mutex
+}
+
+func NewInterrupts(log func(s string)) *Interrupts {
+	return &Interrupts{
+		interrupts: map[string]*common.ConsumptionInterrupt{},
+		log:        log,
+		lock:       &sync.Mutex{},
+	}
+}
+
+// Check notifies the scripts whose interrupts match the plain text of text, and returns text without what they matched.
+func (self *Interrupts) Check(text common.StyledText) common.StyledText {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for name, interrupt := range self.interrupts {
+		plain := text.Plain()
+		start, end, found, err := interrupt.FindMatchIndex(plain)
+		if err != nil {
+			self.log(fmt.Sprintf("ERROR while checking interrupt %+v: %v", interrupt, err))
+			delete(self.interrupts, name)
+		} else if found {
+			client, err := mdnsrpc.Connect(interrupt.Addr)
+			if err != nil {
+				self.log(fmt.Sprintf("ERROR while finding client for interrupt %+v: %v", interrupt, err))
+				delete(self.interrupts, name)
+			} else {
+				if err := self.metrics.Call(client, common.InterruptorInterruptedConsumption, common.InterruptedConsumption{
+					Name:    name,
+					Content: plain[start:end],
+				}, nil); err != nil {
+					self.log(fmt.Sprintf("ERROR while calling client for interrupt %+v: %v", interrupt, err))
+					delete(self.interrupts, name)
+				} else {
+					self.metrics.Add("moxie_interrupt_matches_total", "How many times interrupts matched.", 1, "name", name)
+					if interrupt.Times != 0 {
+						interrupt.Times -= 1
+						if interrupt.Times == 0 {
+							delete(self.interrupts, name)
+						}
+					}
+					text = append(text.Slice(0, start), text.Slice(end, len(plain))...)
+				}
+			}
+		}
+	}
+	return text
+}
+
+// Metrics makes the interrupts count their matches in registry.
+func (self *Interrupts) Metrics(registry *metrics.Registry) *Interrupts {
+	self.metrics = registry
+	return self
+}
+
+func (self *Interrupts) ConsumerInterruptConsumption(interrupt common.ConsumptionInterrupt, unused *struct{}) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, err = interrupt.Compiled(); err != nil {
+		return
+	}
+	self.interrupts[interrupt.Name] = &interrupt
+	return
+}
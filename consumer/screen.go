@@ -0,0 +1,344 @@
+package consumer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/nsf/termbox-go"
+	"github.com/zond/moxie/common"
+)
+
+const (
+	tabWidth    = 8
+	highlightFg = termbox.ColorBlack
+	highlightBg = termbox.ColorYellow
+)
+
+// screen shows the output in a full screen view with its own scrollback, which can be paged and searched while new
+// output keeps arriving.
+type screen struct {
+	// the last line is the one still being received
+	lines    []common.StyledText
+	maxLines int
+	// how many lines are hidden below the view, 0 when following new output
+	scroll     int
+	newBelow   int
+	highlights *Highlights
+	search     *regexp.Regexp
+	searching  bool
+	input      []rune
+	status     string
+	active     bool
+	lock       *sync.Mutex
+}
+
+// newScreen makes a screen keeping maxLines lines, showing them with highlights laid over them.
+func newScreen(maxLines int, highlights *Highlights) *screen {
+	return &screen{
+		lines:      []common.StyledText{nil},
+		maxLines:   maxLines,
+		highlights: highlights,
+		lock:       &sync.Mutex{},
+	}
+}
+
+func (self *screen) add(text common.StyledText) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	plain := text.Plain()
+	start := 0
+	for {
+		index := strings.IndexByte(plain[start:], '\n')
+		if index == -1 {
+			break
+		}
+		last := len(self.lines) - 1
+		self.lines[last] = append(self.lines[last], text.Slice(start, start+index)...)
+		self.lines = append(self.lines, nil)
+		// keep showing the same lines while scrolled back
+		if self.scroll > 0 {
+			self.scroll++
+			self.newBelow++
+		}
+		start += index + 1
+	}
+	last := len(self.lines) - 1
+	self.lines[last] = append(self.lines[last], text.Slice(start, len(plain))...)
+	if drop := len(self.lines) - self.maxLines; drop > 0 {
+		self.lines = self.lines[drop:]
+		if self.scroll > len(self.lines)-1 {
+			self.scroll = len(self.lines) - 1
+		}
+	}
+	self.draw()
+}
+
+func colorAttribute(c common.Color, bold bool) termbox.Attribute {
+	// in 256 color mode attribute n is color n-1, and 0 is the default
+	switch c.Mode {
+	case common.ColorBasic:
+		if bold {
+			return termbox.Attribute(c.Index + 9)
+		}
+		return termbox.Attribute(c.Index + 1)
+	case common.ColorBright:
+		return termbox.Attribute(c.Index + 9)
+	case common.Color256:
+		return termbox.Attribute(c.Index) + 1
+	case common.ColorRGB:
+		return termbox.Attribute(16+36*cubeLevel(c.R)+6*cubeLevel(c.G)+cubeLevel(c.B)) + 1
+	}
+	return termbox.ColorDefault
+}
+
+// cubeLevel returns the closest of the 6 levels per component in the 256 color cube, which are 0, 95, 135, 175, 215
+// and 255.
+func cubeLevel(v byte) int {
+	switch {
+	case v < 48:
+		return 0
+	case v < 115:
+		return 1
+	}
+	return (int(v) - 35) / 40
+}
+
+func attributes(style common.Style) (fg, bg termbox.Attribute) {
+	fg, bg = colorAttribute(style.Foreground, style.Bold), colorAttribute(style.Background, false)
+	for _, flag := range []struct {
+		on   bool
+		attr termbox.Attribute
+	}{
+		{style.Bold, termbox.AttrBold},
+		{style.Faint, termbox.AttrDim},
+		{style.Italic, termbox.AttrCursive},
+		{style.Underline, termbox.AttrUnderline},
+		{style.Blink, termbox.AttrBlink},
+		{style.Inverse, termbox.AttrReverse},
+	} {
+		if flag.on {
+			fg |= flag.attr
+		}
+	}
+	return
+}
+
+// wrap turns a line into rows of at most width cells, with the matches of search highlighted.
+func wrap(line common.StyledText, width int, search *regexp.Regexp) (result [][]termbox.Cell) {
+	var matches [][]int
+	if search != nil {
+		matches = search.FindAllStringIndex(line.Plain(), -1)
+	}
+	cells := []termbox.Cell{}
+	offset := 0
+	for _, span := range line {
+		fg, bg := attributes(span.Style)
+		for index, ch := range span.Text {
+			cell := termbox.Cell{Ch: ch, Fg: fg, Bg: bg}
+			for len(matches) > 0 && matches[0][1] <= offset+index {
+				matches = matches[1:]
+			}
+			if len(matches) > 0 && matches[0][0] <= offset+index && offset+index < matches[0][1] {
+				cell.Fg, cell.Bg = highlightFg, highlightBg
+			}
+			switch {
+			case ch == '\t':
+				cell.Ch = ' '
+				for len(cells)%tabWidth != tabWidth-1 {
+					cells = append(cells, cell)
+				}
+				cells = append(cells, cell)
+			case ch >= ' ' && ch != 0x7f:
+				cells = append(cells, cell)
+			}
+		}
+		offset += len(span.Text)
+	}
+	if width < 1 {
+		width = 1
+	}
+	for len(cells) > width {
+		result = append(result, cells[:width])
+		cells = cells[width:]
+	}
+	return append(result, cells)
+}
+
+// bottom is the index of the line at the bottom of the view.
+func (self *screen) bottom() int {
+	return len(self.lines) - 1 - self.scroll
+}
+
+func (self *screen) scrollTo(scroll int) {
+	if scroll > len(self.lines)-1 {
+		scroll = len(self.lines) - 1
+	}
+	if scroll < 0 {
+		scroll = 0
+	}
+	self.scroll = scroll
+	if self.scroll == 0 {
+		self.newBelow = 0
+	}
+}
+
+// page scrolls about a screen of rows up, or down if direction is -1.
+func (self *screen) page(direction, width, rows int) {
+	scrolled := 0
+	index := self.bottom()
+	if direction < 0 {
+		index++
+	}
+	for ; rows > 0 && index >= 0 && index < len(self.lines); index -= direction {
+		rows -= len(wrap(self.lines[index], width, nil))
+		scrolled++
+	}
+	if scrolled > 1 && rows <= 0 {
+		// keep a line of context
+		scrolled--
+	}
+	self.scrollTo(self.scroll + direction*scrolled)
+}
+
+// find scrolls to the closest line matching the search, starting at from and moving up, or down if direction is -1.
+func (self *screen) find(from, direction int) {
+	if self.search == nil {
+		return
+	}
+	for index := from; index >= 0 && index < len(self.lines); index -= direction {
+		if self.search.MatchString(self.lines[index].Plain()) {
+			self.scrollTo(len(self.lines) - 1 - index)
+			self.status = fmt.Sprintf("/%v", self.search)
+			return
+		}
+	}
+	self.status = fmt.Sprintf("/%v: no more matches", self.search)
+}
+
+func (self *screen) draw() {
+	if !self.active {
+		return
+	}
+	width, height := termbox.Size()
+	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+	textHeight := height - 1
+	rows := [][]termbox.Cell{}
+	for index := self.bottom(); index >= 0 && len(rows) < textHeight; index-- {
+		rows = append(wrap(self.highlights.Apply(self.lines[index]), width, self.search), rows...)
+	}
+	if len(rows) > textHeight {
+		rows = rows[len(rows)-textHeight:]
+	}
+	for y, row := range rows {
+		for x, cell := range row {
+			termbox.SetCell(x, y, cell.Ch, cell.Fg, cell.Bg)
+		}
+	}
+	status := self.status
+	termbox.HideCursor()
+	if self.searching {
+		status = "/" + string(self.input)
+		termbox.SetCursor(len([]rune(status)), height-1)
+	} else if self.scroll > 0 {
+		if self.newBelow > 0 {
+			status = fmt.Sprintf("-- %v new lines below, End to follow -- %v", self.newBelow, status)
+		} else {
+			status = fmt.Sprintf("-- %v lines below, End to follow -- %v", self.scroll, status)
+		}
+	}
+	for x, ch := range []rune(status) {
+		termbox.SetCell(x, height-1, ch, termbox.ColorDefault|termbox.AttrReverse, termbox.ColorDefault)
+	}
+	termbox.Flush()
+}
+
+func (self *screen) handleSearchKey(ev termbox.Event) {
+	switch ev.Key {
+	case termbox.KeyEnter:
+		self.searching = false
+		if len(self.input) == 0 {
+			self.search, self.status = nil, ""
+			return
+		}
+		search, err := regexp.Compile(string(self.input))
+		if err != nil {
+			self.status = err.Error()
+			return
+		}
+		self.search = search
+		self.find(self.bottom(), 1)
+	case termbox.KeyEsc:
+		self.searching = false
+	case termbox.KeyBackspace, termbox.KeyBackspace2:
+		if len(self.input) > 0 {
+			self.input = self.input[:len(self.input)-1]
+		}
+	case termbox.KeySpace:
+		self.input = append(self.input, ' ')
+	default:
+		if ev.Ch != 0 {
+			self.input = append(self.input, ev.Ch)
+		}
+	}
+}
+
+// handle returns false when the user wants to quit.
+func (self *screen) handle(ev termbox.Event) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if ev.Type == termbox.EventKey {
+		width, height := termbox.Size()
+		switch {
+		case ev.Key == termbox.KeyCtrlC:
+			return false
+		case self.searching:
+			self.handleSearchKey(ev)
+		case ev.Key == termbox.KeyPgup:
+			self.page(1, width, height-1)
+		case ev.Key == termbox.KeyPgdn:
+			self.page(-1, width, height-1)
+		case ev.Key == termbox.KeyArrowUp:
+			self.scrollTo(self.scroll + 1)
+		case ev.Key == termbox.KeyArrowDown:
+			self.scrollTo(self.scroll - 1)
+		case ev.Key == termbox.KeyHome:
+			self.scrollTo(len(self.lines) - 1)
+		case ev.Key == termbox.KeyEnd:
+			self.scrollTo(0)
+		case ev.Key == termbox.KeyEsc:
+			self.search, self.status = nil, ""
+		case ev.Ch == '/':
+			self.searching, self.input, self.status = true, nil, ""
+		case ev.Ch == 'n':
+			self.find(self.bottom()-1, 1)
+		case ev.Ch == 'N':
+			self.find(self.bottom()+1, -1)
+		}
+	}
+	self.draw()
+	return true
+}
+
+// run shows the screen until the user quits.
+func (self *screen) run() (err error) {
+	if err = termbox.Init(); err != nil {
+		return
+	}
+	defer termbox.Close()
+	termbox.SetOutputMode(termbox.Output256)
+	self.lock.Lock()
+	self.active = true
+	self.draw()
+	self.lock.Unlock()
+	for ev := termbox.PollEvent(); ev.Type != termbox.EventError; ev = termbox.PollEvent() {
+		if !self.handle(ev) {
+			break
+		}
+	}
+	self.lock.Lock()
+	self.active = false
+	self.lock.Unlock()
+	return
+}
@@ -0,0 +1,96 @@
+package consumer
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/nsf/termbox-go"
+	"github.com/zond/moxie/common"
+)
+
+func plainLines(s *screen) (result []string) {
+	for _, line := range s.lines {
+		result = append(result, line.Plain())
+	}
+	return
+}
+
+func TestScreenAdd(t *testing.T) {
+	s := newScreen(4, NewHighlights())
+	parser := &common.ANSIParser{}
+	s.add(parser.Parse([]byte("one\r\n\x1b[31mtw")))
+	s.add(parser.Parse([]byte("o\n")))
+	if found := plainLines(s); !reflect.DeepEqual(found, []string{"one\r", "two", ""}) {
+		t.Fatalf("Got %#v", found)
+	}
+	if s.lines[1][0].Style.Foreground.Mode != common.ColorBasic {
+		t.Fatalf("Lost the color of %+v", s.lines[1])
+	}
+	s.scrollTo(1)
+	s.add(parser.Parse([]byte("three\nfour\n")))
+	if found := plainLines(s); !reflect.DeepEqual(found, []string{"two", "three", "four", ""}) {
+		t.Fatalf("Got %#v", found)
+	}
+	if s.scroll != 3 || s.newBelow != 2 || s.lines[s.bottom()].Plain() != "two" {
+		t.Fatalf("Wanted the view to stay on two, got scroll %v and %v new lines", s.scroll, s.newBelow)
+	}
+	s.scrollTo(0)
+	if s.newBelow != 0 {
+		t.Fatalf("Wanted no new lines when following, got %v", s.newBelow)
+	}
+}
+
+func TestScreenFind(t *testing.T) {
+	s := newScreen(100, NewHighlights())
+	s.add(common.StyledText{{Text: "a dragon\nan orc\na dragon\nthe end"}})
+	s.search = regexp.MustCompile("drag")
+	s.find(s.bottom(), 1)
+	if s.bottom() != 2 {
+		t.Fatalf("Wanted line 2, got %v", s.bottom())
+	}
+	s.find(s.bottom()-1, 1)
+	if s.bottom() != 0 {
+		t.Fatalf("Wanted line 0, got %v", s.bottom())
+	}
+	s.find(s.bottom()-1, 1)
+	if s.bottom() != 0 || s.status != "/drag: no more matches" {
+		t.Fatalf("Wanted to stay on line 0, got %v and %#v", s.bottom(), s.status)
+	}
+	s.find(s.bottom()+1, -1)
+	if s.bottom() != 2 {
+		t.Fatalf("Wanted line 2, got %v", s.bottom())
+	}
+}
+
+func TestScreenPage(t *testing.T) {
+	s := newScreen(100, NewHighlights())
+	s.add(common.StyledText{{Text: "0\n1\n2\n3\n4\n5\n6\n7\n8\n9"}})
+	s.page(1, 80, 4)
+	if s.bottom() != 6 {
+		t.Fatalf("Wanted line 6 at the bottom, got %v", s.bottom())
+	}
+	s.page(-1, 80, 4)
+	if s.scroll != 0 {
+		t.Fatalf("Wanted to follow again, got scroll %v", s.scroll)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	rows := wrap(common.StyledText{{Text: "a\tdragon"}, {Style: common.Style{Bold: true}, Text: " here"}}, 10, regexp.MustCompile("on h"))
+	if len(rows) != 2 || len(rows[0]) != 10 || len(rows[1]) != 9 {
+		t.Fatalf("Got %+v", rows)
+	}
+	if rows[0][1].Ch != ' ' || rows[0][8].Ch != 'd' {
+		t.Fatalf("Wanted the tab expanded, got %+v", rows[0])
+	}
+	for index, cell := range append(rows[0], rows[1]...) {
+		highlighted := index >= 12 && index < 16
+		if (cell.Bg == highlightBg) != highlighted {
+			t.Errorf("Wanted highlighted %v for %q at %v, got %+v", highlighted, cell.Ch, index, cell)
+		}
+	}
+	if rows[1][8].Fg&termbox.AttrBold == 0 {
+		t.Errorf("Wanted bold, got %+v", rows[1][8])
+	}
+}
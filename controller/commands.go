@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zond/mdnsrpc"
+	"github.com/zond/moxie/common"
+)
+
+// runCommand runs the controller commands, which talk to the proxy instead of being sent to the server. It returns
+// false for anything else.
+func (self *Controller) runCommand(str string) (handled bool) {
+	fields := strings.Fields(str)
+	if len(fields) == 0 {
+		return
+	}
+	var run func(client *mdnsrpc.Client) ([]string, error)
+	switch {
+	case fields[0] == "/connect" && len(fields) < 3:
+		request := common.ConnectRequest{Session: self.session}
+		if len(fields) == 2 {
+			request.Addr = fields[1]
+		}
+		run = func(client *mdnsrpc.Client) (result []string, err error) {
+			if err = self.metrics.Call(client, common.ProxyConnect, request, nil); err != nil {
+				return
+			}
+			result = []string{"Connecting"}
+			return
+		}
+	case fields[0] == "/disconnect" && len(fields) == 1:
+		run = func(client *mdnsrpc.Client) (result []string, err error) {
+			if err = self.metrics.Call(client, common.ProxyDisconnect, self.session, nil); err != nil {
+				return
+			}
+			result = []string{"Disconnected"}
+			return
+		}
+	case fields[0] == "/status" && len(fields) == 1:
+		run = func(client *mdnsrpc.Client) (result []string, err error) {
+			status := common.Status{}
+			if err = self.metrics.Call(client, common.ProxyStatus, struct{}{}, &status); err != nil {
+				return
+			}
+			result = statusLines(status, time.Now())
+			return
+		}
+	default:
+		return
+	}
+	handled = true
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err == nil {
+		self.message, err = run(client)
+	}
+	if err != nil {
+		self.message = []string{err.Error()}
+	}
+	return
+}
+
+func statusLines(status common.Status, now time.Time) (result []string) {
+	for _, sess := range status.Sessions {
+		switch {
+		case sess.Replaying:
+			result = append(result, fmt.Sprintf("%v: replaying %v, %v queued commands", sess.Session, sess.Addr, sess.QueuedCommands))
+		case sess.Connected:
+			result = append(result, fmt.Sprintf("%v: connected to %v since %v (%v), %v bytes in, %v bytes out, %v queued commands", sess.Session, sess.Addr, sess.ConnectedSince.Format("2006-01-02 15:04:05"), now.Sub(sess.ConnectedSince).Round(time.Second), sess.BytesIn, sess.BytesOut, sess.QueuedCommands))
+		default:
+			result = append(result, fmt.Sprintf("%v: disconnected from %v, %v queued commands", sess.Session, sess.Addr, sess.QueuedCommands))
+		}
+		options := []string{}
+		for _, option := range sess.TelnetOptions {
+			if option.Local || option.Remote {
+				options = append(options, option.String())
+			}
+		}
+		if len(options) > 0 {
+			result = append(result, fmt.Sprintf("  telnet options: %v", strings.Join(options, ", ")))
+		}
+		if tls := sess.TLS; tls != nil {
+			result = append(result, fmt.Sprintf("  tls: %v, %v, server name %#v, verified: %v", tls.Version, tls.CipherSuite, tls.ServerName, tls.Verified))
+			result = append(result, fmt.Sprintf("  certificate: %v, issued by %v, expires %v, fingerprint %v", tls.Subject, tls.Issuer, tls.NotAfter.Format("2006-01-02"), tls.Fingerprint))
+		}
+	}
+	for _, client := range status.Clients {
+		result = append(result, fmt.Sprintf("%v %v: %v delivered, %v dropped, %v failed, %v/%v queued, %v behind", client.Service, client.Addr, client.Delivered, client.Dropped, client.Failed, client.Queued, client.Capacity, client.Lag))
+	}
+	return
+}
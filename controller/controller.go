@@ -4,20 +4,17 @@ import (
 	"bytes"
 	"fmt"
 	"log"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/nsf/termbox-go"
 	"github.com/zond/mdnsrpc"
 	"github.com/zond/moxie/common"
+	"github.com/zond/moxie/metrics"
 )
 
-var history = []byte("history")
 var splitReg = regexp.MustCompile("\\W+")
 
 const (
@@ -33,12 +30,16 @@ type Controller struct {
 	cursor        int
 	buffer        []rune
 	dir           string
-	db            *bolt.DB
+	session       string
+	masked        bool
+	history       *History
 	lastHistory   []byte
 	mode          int
 	historySearch []rune
 	completeTree  *common.CompleteNode
 	interrupts    map[string]*common.TransmissionInterrupt
+	message       []string
+	metrics       *metrics.Registry
 	lock          *sync.RWMutex
 }
 
@@ -54,6 +55,18 @@ func (self *Controller) Dir(d string) *Controller {
 	return self
 }
 
+// Session makes the controller send its input to the named session, instead of the default one.
+func (self *Controller) Session(name string) *Controller {
+	self.session = name
+	return self
+}
+
+// Metrics makes the controller record what it does in registry.
+func (self *Controller) Metrics(registry *metrics.Registry) *Controller {
+	self.metrics = registry
+	return self
+}
+
 func (self *Controller) Publish(unused struct{}, unused2 *struct{}) (err error) {
 	_, err = mdnsrpc.Publish(common.Subscriber, self)
 	if err != nil {
@@ -76,12 +89,12 @@ func (self *Controller) ControllerInterruptTransmission(interrupt common.Transmi
 	return
 }
 
-func (self *Controller) SubscriberTransmit(b []byte, unused *struct{}) (err error) {
+func (self *Controller) SubscriberTransmit(chunk common.Chunk, unused *struct{}) (err error) {
 	return
 }
 
-func (self *Controller) SubscriberReceive(b []byte, unused *struct{}) (err error) {
-	for _, part := range splitReg.Split(string(b), -1) {
+func (self *Controller) SubscriberReceive(chunk common.Chunk, unused *struct{}) (err error) {
+	for _, part := range splitReg.Split(string(chunk.Data), -1) {
 		self.rememberCompletion(part)
 	}
 	return
@@ -91,6 +104,68 @@ func (self *Controller) SubscriberLog(s string, unused *struct{}) (err error) {
 	return
 }
 
+func (self *Controller) SubscriberLine(line common.Line, unused *struct{}) (err error) {
+	return
+}
+
+// SubscriberEcho asks the proxy about the echo state of our own session, since an empty session name can mean
+// different sessions depending on which ones exist.
+func (self *Controller) SubscriberEcho(state common.EchoState, unused *struct{}) (err error) {
+	go self.updateMasked()
+	return
+}
+
+func (self *Controller) updateMasked() {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	options := []common.TelnetOption{}
+	if err = self.metrics.Call(client, common.ProxyTelnetOptions, self.session, &options); err != nil {
+		return
+	}
+	masked := false
+	for _, option := range options {
+		if option.Code == common.TelnetOptionEcho {
+			masked = option.Remote
+		}
+	}
+	self.lock.Lock()
+	changed := masked != self.masked
+	self.masked = masked
+	self.lock.Unlock()
+	if changed {
+		// wake up the event loop to redraw the input
+		termbox.Interrupt()
+	}
+}
+
+func (self *Controller) isMasked() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.masked
+}
+
+func (self *Controller) SubscriberGMCP(msg common.GMCPMessage, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Controller) SubscriberMSDP(variable common.MSDPVariable, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Controller) SubscriberMSSP(status common.MSSPStatus, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Controller) SubscriberConnected(event common.ConnectionEvent, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Controller) SubscriberDisconnected(event common.ConnectionEvent, unused *struct{}) (err error) {
+	return
+}
+
 func (self *Controller) rememberCompletion(s string) {
 	if len(s) > 3 {
 		self.completeTree = self.completeTree.Insert([]byte(s))
@@ -106,7 +181,7 @@ func (self *Controller) Log(s string, unused *struct{}) (err error) {
 		log.Printf("%v", err.Error())
 	} else {
 		for _, client := range loggers {
-			if err := client.Call(common.SubscriberLog, s, nil); err != nil {
+			if err := self.metrics.Call(client, common.SubscriberLog, s, nil); err != nil {
 				log.Printf("%v", err.Error())
 			}
 		}
@@ -126,6 +201,18 @@ func (self *Controller) setRunes(r []rune) (err error) {
 	return
 }
 
+// setMessage shows the output of the last controller command on the lines below the input.
+func (self *Controller) setMessage(inputLength int) {
+	width, _ := termbox.Size()
+	y := inputLength/width + 1
+	for _, line := range self.message {
+		for index, ch := range []rune(line) {
+			termbox.SetCell(index%width, y+index/width, ch, termbox.ColorDefault, termbox.ColorDefault)
+		}
+		y += len([]rune(line))/width + 1
+	}
+}
+
 func (self *Controller) setCursor(i int) {
 	width, height := termbox.Size()
 	cursorX, cursorY := i%width, i/width
@@ -138,9 +225,14 @@ func (self *Controller) setCursor(i int) {
 func (self *Controller) update() (err error) {
 	switch self.mode {
 	case regular:
-		if err = self.setRunes(self.buffer); err != nil {
+		shown := self.buffer
+		if self.isMasked() {
+			shown = []rune(strings.Repeat("*", len(self.buffer)))
+		}
+		if err = self.setRunes(shown); err != nil {
 			return
 		}
+		self.setMessage(len(shown))
 		self.setCursor(self.cursor)
 	case historySearch:
 		if err = self.setRunes([]rune(fmt.Sprintf("%s%s`: %s", historySearchHeader, string(self.buffer), string(self.historySearch)))); err != nil {
@@ -175,122 +267,17 @@ func (self *Controller) backspace() {
 	}
 }
 
-func (self *Controller) timeToBytes(t time.Time) (result []byte) {
-	result = make([]byte, 8)
-	ns := t.UnixNano()
-	result[7] = byte(ns)
-	result[6] = byte(ns >> 8)
-	result[5] = byte(ns >> 16)
-	result[4] = byte(ns >> 24)
-	result[3] = byte(ns >> 32)
-	result[2] = byte(ns >> 40)
-	result[1] = byte(ns >> 48)
-	result[0] = byte(ns >> 56)
-	return
-}
-
-func (self *Controller) pushHistory(b []rune) (err error) {
-	return self.db.Update(func(tx *bolt.Tx) (err error) {
-		bucket, err := tx.CreateBucketIfNotExists(history)
-		if err != nil {
-			return
-		}
-		if err = bucket.Put(self.timeToBytes(time.Now()), []byte(string(b))); err != nil {
-			return
-		}
-		return
-	})
-}
-
 type CtrlC string
 
 func (self CtrlC) Error() string {
 	return string(self)
 }
 
-func (self *Controller) nextHistory(lastHistory []byte) (newHistory, result []byte, found bool, err error) {
-	if lastHistory == nil {
-		return
-	}
-	err = self.db.Update(func(tx *bolt.Tx) (err error) {
-		bucket, err := tx.CreateBucketIfNotExists(history)
-		if err != nil {
-			return
-		}
-		cursor := bucket.Cursor()
-		if checkOld, _ := cursor.Seek(lastHistory); checkOld == nil {
-			found = false
-		} else {
-			newHistory, result = cursor.Next()
-			found = true
-		}
-		return
-	})
-	return
-}
-
-func (self *Controller) prevHistory(lastHistory []byte) (newHistory, result []byte, found bool, err error) {
-	err = self.db.Update(func(tx *bolt.Tx) (err error) {
-		bucket, err := tx.CreateBucketIfNotExists(history)
-		if err != nil {
-			return
-		}
-		cursor := bucket.Cursor()
-		if lastHistory == nil {
-			newHistory, result = cursor.Last()
-			found = newHistory != nil
-		} else {
-			if checkOld, _ := cursor.Seek(lastHistory); checkOld == nil {
-				found = false
-			} else {
-				if newHistory, result = cursor.Prev(); newHistory == nil {
-					newHistory = lastHistory
-				} else {
-					found = true
-				}
-			}
-		}
-		return
-	})
-	return
-}
-
-func (self *Controller) searchPrevHistory(lastHistory []byte, needle []rune) (newHistory, result []byte, found bool, err error) {
-	err = self.db.Update(func(tx *bolt.Tx) (err error) {
-		bucket, err := tx.CreateBucketIfNotExists(history)
-		if err != nil {
-			return
-		}
-		cursor := bucket.Cursor()
-		tries := 0
-		if lastHistory == nil {
-			newHistory, result = cursor.Last()
-		} else {
-			if checkOld, _ := cursor.Seek(lastHistory); checkOld == nil {
-				newHistory, result = cursor.Last()
-			} else {
-				newHistory, result = cursor.Prev()
-				tries = 1
-			}
-		}
-		for (tries > 0 || newHistory != nil) && !strings.Contains(string(result), string(needle)) {
-			newHistory, result = cursor.Prev()
-			if newHistory == nil && tries > 0 {
-				tries -= 1
-				newHistory, result = cursor.Last()
-			}
-		}
-		found = newHistory != nil
-		return
-	})
-	return
-}
-
 func (self *Controller) updateHistorySearch() (err error) {
 	if len(self.buffer) > 0 {
 		var hist []byte
 		var found bool
-		self.lastHistory, hist, found, err = self.searchPrevHistory(self.lastHistory, self.buffer)
+		self.lastHistory, hist, found, err = self.history.SearchPrev(self.lastHistory, string(self.buffer))
 		if err != nil {
 			return
 		}
@@ -301,14 +288,36 @@ func (self *Controller) updateHistorySearch() (err error) {
 	return
 }
 
+func (self *Controller) reportWindowSize() {
+	width, height := termbox.Size()
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	if err = self.metrics.Call(client, common.ProxyWindowSize, common.WindowSize{
+		Source: common.WindowSizeController,
+		Width:  width,
+		Height: height,
+	}, nil); err != nil {
+		self.Log(err.Error(), nil)
+	}
+}
+
 func (self *Controller) sendToProxy(buffer []rune) (err error) {
 	var client *mdnsrpc.Client
 	if client, err = mdnsrpc.LookupOne(common.Proxy); err != nil {
 		return
 	}
-	if err = client.Call(common.ProxyTransmit, string(self.buffer)+"\n", nil); err != nil {
+	chunk := common.Chunk{
+		Session: self.session,
+		Data:    []byte(string(self.buffer) + "\n"),
+	}
+	if err = self.metrics.Call(client, common.ProxyTransmit, chunk, nil); err != nil {
 		return
 	}
+	// the proxy marks chunks as transmitted when it sends them, but the metrics count them as transmitted here already
+	chunk.Transmitted = true
+	self.metrics.CountChunk(chunk)
 	return
 }
 
@@ -332,10 +341,16 @@ func (self *Controller) handle(ev termbox.Event) (err error) {
 				case regular:
 					if len(self.buffer) > 0 {
 						str := string(self.buffer)
-						interrupted := false
+						// passwords must not reach scripts, the history or the completions
+						masked := self.isMasked()
+						self.message = nil
+						interrupted := !masked && self.runCommand(str)
 						self.lock.Lock()
 						func() {
 							defer self.lock.Unlock()
+							if masked || interrupted {
+								return
+							}
 							for name, interrupt := range self.interrupts {
 								var compiled *regexp.Regexp
 								compiled, err = interrupt.Compiled()
@@ -349,13 +364,14 @@ func (self *Controller) handle(ev termbox.Event) (err error) {
 											self.Log(err.Error(), nil)
 											delete(self.interrupts, name)
 										} else {
-											if err := client.Call(common.InterruptorInterruptedTransmission, common.InterruptedTransmission{
+											if err := self.metrics.Call(client, common.InterruptorInterruptedTransmission, common.InterruptedTransmission{
 												Name:  name,
 												Match: match,
 											}, nil); err != nil {
 												self.Log(err.Error(), nil)
 												delete(self.interrupts, name)
 											} else {
+												self.metrics.Add("moxie_interrupt_matches_total", "How many times interrupts matched.", 1, "name", name)
 												interrupted = true
 											}
 										}
@@ -371,11 +387,13 @@ func (self *Controller) handle(ev termbox.Event) (err error) {
 						if err = termbox.Clear(termbox.ColorDefault, termbox.ColorDefault); err != nil {
 							return
 						}
-						if err = self.pushHistory(self.buffer); err != nil {
-							return
-						}
-						for _, part := range splitReg.Split(string(self.buffer), -1) {
-							self.rememberCompletion(part)
+						if !masked {
+							if err = self.history.Push(string(self.buffer)); err != nil {
+								return
+							}
+							for _, part := range splitReg.Split(string(self.buffer), -1) {
+								self.rememberCompletion(part)
+							}
 						}
 						self.buffer = nil
 						self.cursor = 0
@@ -396,7 +414,7 @@ func (self *Controller) handle(ev termbox.Event) (err error) {
 				if self.mode == regular {
 					var hist []byte
 					var found bool
-					self.lastHistory, hist, found, err = self.nextHistory(self.lastHistory)
+					self.lastHistory, hist, found, err = self.history.Next(self.lastHistory)
 					if err != nil {
 						return
 					}
@@ -414,7 +432,7 @@ func (self *Controller) handle(ev termbox.Event) (err error) {
 				if self.mode == regular {
 					var hist []byte
 					var found bool
-					self.lastHistory, hist, found, err = self.prevHistory(self.lastHistory)
+					self.lastHistory, hist, found, err = self.history.Prev(self.lastHistory)
 					if err != nil {
 						return
 					}
@@ -452,6 +470,11 @@ func (self *Controller) handle(ev termbox.Event) (err error) {
 			return
 		}
 	case termbox.EventResize:
+		go self.reportWindowSize()
+		if err = self.update(); err != nil {
+			return
+		}
+	case termbox.EventInterrupt:
 		if err = self.update(); err != nil {
 			return
 		}
@@ -460,10 +483,7 @@ func (self *Controller) handle(ev termbox.Event) (err error) {
 }
 
 func (self *Controller) Control(unused struct{}, unused2 *struct{}) (err error) {
-	if err = os.MkdirAll(self.dir, 0700); err != nil && !os.IsExist(err) {
-		return
-	}
-	if self.db, err = bolt.Open(filepath.Join(self.dir, "controller.db"), 0700, nil); err != nil {
+	if self.history, err = NewHistory(self.dir); err != nil {
 		return
 	}
 	if err = termbox.Init(); err != nil {
@@ -474,6 +494,8 @@ func (self *Controller) Control(unused struct{}, unused2 *struct{}) (err error)
 			termbox.Close()
 		}
 	}()
+	go self.reportWindowSize()
+	go self.updateMasked()
 	if err = self.update(); err != nil {
 		return
 	}
@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	historyTimeout = 5 * time.Second
+)
+
+var history = []byte("history")
+
+// History is the command history kept under the dir. The database is only open during each operation, so that the
+// controller and the web gateway can share it.
+type History struct {
+	path string
+}
+
+func NewHistory(dir string) (result *History, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil && !os.IsExist(err) {
+		return
+	}
+	result = &History{
+		path: filepath.Join(dir, "controller.db"),
+	}
+	return
+}
+
+func timeToBytes(t time.Time) (result []byte) {
+	result = make([]byte, 8)
+	ns := t.UnixNano()
+	result[7] = byte(ns)
+	result[6] = byte(ns >> 8)
+	result[5] = byte(ns >> 16)
+	result[4] = byte(ns >> 24)
+	result[3] = byte(ns >> 32)
+	result[2] = byte(ns >> 40)
+	result[1] = byte(ns >> 48)
+	result[0] = byte(ns >> 56)
+	return
+}
+
+// update runs f with the history bucket. Anything f wants to keep from the bucket must be copied, since the database is
+// closed afterwards.
+func (self *History) update(f func(bucket *bolt.Bucket) error) (err error) {
+	db, err := bolt.Open(self.path, 0700, &bolt.Options{Timeout: historyTimeout})
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) (err error) {
+		bucket, err := tx.CreateBucketIfNotExists(history)
+		if err != nil {
+			return
+		}
+		return f(bucket)
+	})
+}
+
+func copyEntry(k, v []byte) ([]byte, []byte) {
+	return append([]byte(nil), k...), append([]byte(nil), v...)
+}
+
+func (self *History) Push(s string) (err error) {
+	return self.update(func(bucket *bolt.Bucket) error {
+		return bucket.Put(timeToBytes(time.Now()), []byte(s))
+	})
+}
+
+func (self *History) Next(lastHistory []byte) (newHistory, result []byte, found bool, err error) {
+	if lastHistory == nil {
+		return
+	}
+	err = self.update(func(bucket *bolt.Bucket) (err error) {
+		cursor := bucket.Cursor()
+		if checkOld, _ := cursor.Seek(lastHistory); checkOld == nil {
+			found = false
+		} else {
+			newHistory, result = copyEntry(cursor.Next())
+			found = true
+		}
+		return
+	})
+	return
+}
+
+func (self *History) Prev(lastHistory []byte) (newHistory, result []byte, found bool, err error) {
+	err = self.update(func(bucket *bolt.Bucket) (err error) {
+		cursor := bucket.Cursor()
+		if lastHistory == nil {
+			newHistory, result = copyEntry(cursor.Last())
+			found = newHistory != nil
+		} else {
+			if checkOld, _ := cursor.Seek(lastHistory); checkOld == nil {
+				found = false
+			} else {
+				if newHistory, result = copyEntry(cursor.Prev()); newHistory == nil {
+					newHistory = lastHistory
+				} else {
+					found = true
+				}
+			}
+		}
+		return
+	})
+	return
+}
+
+func (self *History) SearchPrev(lastHistory []byte, needle string) (newHistory, result []byte, found bool, err error) {
+	err = self.update(func(bucket *bolt.Bucket) (err error) {
+		cursor := bucket.Cursor()
+		tries := 0
+		if lastHistory == nil {
+			newHistory, result = cursor.Last()
+		} else {
+			if checkOld, _ := cursor.Seek(lastHistory); checkOld == nil {
+				newHistory, result = cursor.Last()
+			} else {
+				newHistory, result = cursor.Prev()
+				tries = 1
+			}
+		}
+		for (tries > 0 || newHistory != nil) && !strings.Contains(string(result), needle) {
+			newHistory, result = cursor.Prev()
+			if newHistory == nil && tries > 0 {
+				tries -= 1
+				newHistory, result = cursor.Last()
+			}
+		}
+		found = newHistory != nil
+		newHistory, result = copyEntry(newHistory, result)
+		return
+	})
+	return
+}
+
+// Last returns the n latest entries, oldest first.
+func (self *History) Last(n int) (result []string, err error) {
+	err = self.update(func(bucket *bolt.Bucket) (err error) {
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil && len(result) < n; k, v = cursor.Prev() {
+			result = append(result, string(v))
+		}
+		return
+	})
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return
+}
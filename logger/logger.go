@@ -2,12 +2,15 @@ package logger
 
 import (
 	"log"
+	"time"
 
 	"github.com/zond/mdnsrpc"
 	"github.com/zond/moxie/common"
+	"github.com/zond/moxie/metrics"
 )
 
 type Logger struct {
+	metrics *metrics.Registry
 }
 
 func New() (result *Logger) {
@@ -15,6 +18,12 @@ func New() (result *Logger) {
 	return
 }
 
+// Metrics makes the logger record what it does in registry.
+func (self *Logger) Metrics(registry *metrics.Registry) *Logger {
+	self.metrics = registry
+	return self
+}
+
 func (self *Logger) Publish(unused struct{}, unused2 *struct{}) (err error) {
 	done, err := mdnsrpc.Publish(common.Subscriber, self)
 	if err != nil {
@@ -26,13 +35,54 @@ func (self *Logger) Publish(unused struct{}, unused2 *struct{}) (err error) {
 	return
 }
 
-func (self *Logger) SubscriberTransmit(b []byte, unused *struct{}) (err error) {
-	log.Printf("TRANSMIT\t%#v", string(b))
+func (self *Logger) SubscriberTransmit(chunk common.Chunk, unused *struct{}) (err error) {
+	self.metrics.CountChunk(chunk)
+	log.Printf("TRANSMIT\t%v\t%v\t%v\t%#v", chunk.Seq, chunk.Time.Format(time.RFC3339Nano), chunk.Session, string(chunk.Data))
+	return
+}
+
+func (self *Logger) SubscriberReceive(chunk common.Chunk, unused *struct{}) (err error) {
+	self.metrics.CountChunk(chunk)
+	log.Printf("RECEIVE\t%v\t%v\t%v\t%#v", chunk.Seq, chunk.Time.Format(time.RFC3339Nano), chunk.Session, string(chunk.Data))
+	return
+}
+
+func (self *Logger) SubscriberLine(line common.Line, unused *struct{}) (err error) {
+	kind := "LINE"
+	if line.Prompt {
+		kind = "PROMPT"
+	}
+	log.Printf("%v\t%v\t%v\t%v\t%#v", kind, line.Seq, line.Time.Format(time.RFC3339Nano), line.Session, line.Text)
+	return
+}
+
+func (self *Logger) SubscriberEcho(state common.EchoState, unused *struct{}) (err error) {
+	log.Printf("ECHO\t%+v", state)
+	return
+}
+
+func (self *Logger) SubscriberGMCP(msg common.GMCPMessage, unused *struct{}) (err error) {
+	log.Printf("GMCP\t%v\t%v", msg.Session, msg)
+	return
+}
+
+func (self *Logger) SubscriberMSDP(variable common.MSDPVariable, unused *struct{}) (err error) {
+	log.Printf("MSDP\t%v\t%v", variable.Session, variable)
+	return
+}
+
+func (self *Logger) SubscriberMSSP(status common.MSSPStatus, unused *struct{}) (err error) {
+	log.Printf("MSSP\t%v\t%v", status.Session, status.Values)
+	return
+}
+
+func (self *Logger) SubscriberConnected(event common.ConnectionEvent, unused *struct{}) (err error) {
+	log.Printf("CONNECTED\t%+v", event)
 	return
 }
 
-func (self *Logger) SubscriberReceive(b []byte, unused *struct{}) (err error) {
-	log.Printf("RECEIVE\t%#v", string(b))
+func (self *Logger) SubscriberDisconnected(event common.ConnectionEvent, unused *struct{}) (err error) {
+	log.Printf("DISCONNECTED\t%+v", event)
 	return
 }
 
@@ -0,0 +1,261 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/mdnsrpc"
+	"github.com/zond/moxie/common"
+)
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// Buckets are the upper bounds, in seconds, of the latency histograms.
+var Buckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type sample struct {
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+type family struct {
+	help    string
+	kind    string
+	read    func() float64
+	samples map[string]*sample
+}
+
+// Registry collects counters, gauges and latency histograms, and serves them in the Prometheus text format. A nil
+// *Registry ignores everything.
+type Registry struct {
+	families map[string]*family
+	lock     *sync.Mutex
+}
+
+func New() *Registry {
+	return &Registry{
+		families: map[string]*family{},
+		lock:     &sync.Mutex{},
+	}
+}
+
+// labelEscaper escapes label values the way the text format wants, which is not quite like Go strings.
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func label(name, value string) string {
+	return fmt.Sprintf("%v=\"%v\"", name, labelEscaper.Replace(value))
+}
+
+// labelString renders name/value pairs like {name="value",other="value"}.
+func labelString(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := []string{}
+	for index := 0; index+1 < len(labels); index += 2 {
+		parts = append(parts, label(labels[index], labels[index+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (self *Registry) sample(name, help, kind string, labels []string) (result *sample) {
+	fam, found := self.families[name]
+	if !found {
+		fam = &family{
+			help:    help,
+			kind:    kind,
+			samples: map[string]*sample{},
+		}
+		self.families[name] = fam
+	}
+	key := labelString(labels)
+	if result = fam.samples[key]; result == nil {
+		result = &sample{}
+		if kind == kindHistogram {
+			result.buckets = make([]uint64, len(Buckets))
+		}
+		fam.samples[key] = result
+	}
+	return
+}
+
+// Add adds value to a counter. labels are name/value pairs.
+func (self *Registry) Add(name, help string, value float64, labels ...string) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.sample(name, help, kindCounter, labels).value += value
+}
+
+// Set sets a gauge. labels are name/value pairs.
+func (self *Registry) Set(name, help string, value float64, labels ...string) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.sample(name, help, kindGauge, labels).value = value
+}
+
+// Func makes a gauge without labels that calls read every time the metrics are served.
+func (self *Registry) Func(name, help string, read func() float64) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.families[name] = &family{
+		help: help,
+		kind: kindGauge,
+		read: read,
+	}
+}
+
+// Observe adds a duration to a histogram. labels are name/value pairs.
+func (self *Registry) Observe(name, help string, duration time.Duration, labels ...string) {
+	if self == nil {
+		return
+	}
+	seconds := duration.Seconds()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	s := self.sample(name, help, kindHistogram, labels)
+	for index, bound := range Buckets {
+		if seconds <= bound {
+			s.buckets[index]++
+		}
+	}
+	s.count++
+	s.value += seconds
+}
+
+// Time runs call, and records how long it took and if it failed as a call of method to addr.
+func (self *Registry) Time(method, addr string, call func() error) (err error) {
+	started := time.Now()
+	err = call()
+	self.Observe("moxie_rpc_duration_seconds", "How long RPC calls took.", time.Now().Sub(started), "method", method, "addr", addr)
+	if err != nil {
+		self.Add("moxie_rpc_errors_total", "How many RPC calls failed.", 1, "method", method, "addr", addr)
+	}
+	return
+}
+
+// Call calls method on client, like client.Call, and records it like Time.
+func (self *Registry) Call(client *mdnsrpc.Client, method string, arg interface{}, result interface{}) (err error) {
+	return self.Time(method, client.Addr.String(), func() error {
+		return client.Call(method, arg, result)
+	})
+}
+
+// CountChunk counts chunk, and its bytes, as received or transmitted.
+func (self *Registry) CountChunk(chunk common.Chunk) {
+	direction := "received"
+	if chunk.Transmitted {
+		direction = "transmitted"
+	}
+	self.Add("moxie_chunks_total", "How many chunks passed through.", 1, "session", chunk.Session, "direction", direction)
+	self.Add("moxie_bytes_total", "How many bytes of text passed through.", float64(len(chunk.Data)), "session", chunk.Session, "direction", direction)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// withLabel adds one more name/value pair to a rendered label string.
+func withLabel(key, name, value string) string {
+	if key == "" {
+		return "{" + label(name, value) + "}"
+	}
+	return key[:len(key)-1] + "," + label(name, value) + "}"
+}
+
+func (self *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	names := make([]string, 0, len(self.families))
+	for name := range self.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{}
+	reads := map[int]func() float64{}
+	for _, name := range names {
+		fam := self.families[name]
+		lines = append(lines, fmt.Sprintf("# HELP %v %v", name, fam.help), fmt.Sprintf("# TYPE %v %v", name, fam.kind))
+		if fam.read != nil {
+			// read outside the lock, it may need locks of its own
+			reads[len(lines)] = fam.read
+			lines = append(lines, name)
+			continue
+		}
+		keys := make([]string, 0, len(fam.samples))
+		for key := range fam.samples {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := fam.samples[key]
+			if fam.kind != kindHistogram {
+				lines = append(lines, fmt.Sprintf("%v%v %v", name, key, formatFloat(s.value)))
+				continue
+			}
+			for index, bound := range Buckets {
+				lines = append(lines, fmt.Sprintf("%v_bucket%v %v", name, withLabel(key, "le", formatFloat(bound)), s.buckets[index]))
+			}
+			lines = append(lines,
+				fmt.Sprintf("%v_bucket%v %v", name, withLabel(key, "le", "+Inf"), s.count),
+				fmt.Sprintf("%v_sum%v %v", name, key, formatFloat(s.value)),
+				fmt.Sprintf("%v_count%v %v", name, key, s.count))
+		}
+	}
+	self.lock.Unlock()
+	for index, read := range reads {
+		lines[index] = fmt.Sprintf("%v %v", lines[index], formatFloat(read()))
+	}
+	written, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	n = int64(written)
+	return
+}
+
+func (self *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	self.WriteTo(w)
+}
+
+// Serve serves the metrics at /metrics on addr, in the background. Failing to serve after listening only stops the
+// metrics, not whatever is being measured.
+func (self *Registry) Serve(addr string) (err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", self)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Stopped serving metrics at %v: %v", addr, err)
+		}
+	}()
+	return
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+func TestNil(t *testing.T) {
+	var registry *Registry
+	registry.Add("a", "b", 1)
+	registry.CountChunk(common.Chunk{Data: []byte("x")})
+	if err := registry.Time("m", "addr", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := registry.WriteTo(buf); err != nil || buf.Len() != 0 {
+		t.Fatalf("Wanted nothing, got %#v, %v", buf.String(), err)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	registry := New()
+	registry.CountChunk(common.Chunk{Session: "default", Data: []byte("hello\n")})
+	registry.CountChunk(common.Chunk{Session: "default", Data: []byte("look\n"), Transmitted: true})
+	registry.CountChunk(common.Chunk{Session: "default", Data: []byte("bye\n")})
+	registry.Func("moxie_depth", "Depth.", func() float64 { return 3 })
+	registry.Set("moxie_gauge", "A \"gauge\".", 2.5, "name", "a\"b\\c\nd")
+	registry.Time("ProxyTransmit", "127.0.0.1:1", func() error { return errors.New("failed") })
+	registry.Observe("moxie_latency_seconds", "Latency.", time.Millisecond*3)
+	buf := &bytes.Buffer{}
+	if _, err := registry.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	found := buf.String()
+	for _, expected := range []string{
+		"# TYPE moxie_bytes_total counter\n",
+		`moxie_bytes_total{session="default",direction="received"} 10` + "\n",
+		`moxie_bytes_total{session="default",direction="transmitted"} 5` + "\n",
+		`moxie_chunks_total{session="default",direction="received"} 2` + "\n",
+		"# TYPE moxie_depth gauge\nmoxie_depth 3\n",
+		`moxie_gauge{name="a\"b\\c\nd"} 2.5` + "\n",
+		`moxie_latency_seconds_bucket{le="0.0025"} 0` + "\n",
+		`moxie_latency_seconds_bucket{le="0.005"} 1` + "\n",
+		`moxie_latency_seconds_bucket{le="+Inf"} 1` + "\n",
+		"moxie_latency_seconds_sum 0.003\n",
+		"moxie_latency_seconds_count 1\n",
+		`moxie_rpc_errors_total{method="ProxyTransmit",addr="127.0.0.1:1"} 1` + "\n",
+		`moxie_rpc_duration_seconds_count{method="ProxyTransmit",addr="127.0.0.1:1"} 1` + "\n",
+	} {
+		if !strings.Contains(found, expected) {
+			t.Errorf("Wanted %#v in\n%v", expected, found)
+		}
+	}
+}
@@ -3,13 +3,21 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/zond/moxie/common"
 	"github.com/zond/moxie/consumer"
 	"github.com/zond/moxie/controller"
 	"github.com/zond/moxie/logger"
+	"github.com/zond/moxie/metrics"
 	"github.com/zond/moxie/proxy"
+	"github.com/zond/moxie/recorder"
+	"github.com/zond/moxie/web"
 )
 
 const (
@@ -17,6 +25,9 @@ const (
 	modeControl = "control"
 	modeProxy   = "proxy"
 	modeLog     = "log"
+	modeWeb     = "web"
+	modeRecord  = "record"
+	modeReplay  = "replay"
 )
 
 var modes = []string{
@@ -24,44 +35,165 @@ var modes = []string{
 	modeControl,
 	modeProxy,
 	modeLog,
+	modeWeb,
+	modeRecord,
+	modeReplay,
+}
+
+var unsafeNameChars = regexp.MustCompile("[^A-Za-z0-9._-]+")
+
+// spillDir returns where a proxy serving the servers or recordings in spec keeps the scrollback it spills to disk, so
+// that proxies sharing -dir don't overwrite each other's spill.
+func spillDir(dir, spec string) string {
+	return filepath.Join(dir, "scrollback", unsafeNameChars.ReplaceAllString(spec, "_"))
+}
+
+// fail reports a problem with the flags or what they point to, which is not a bug worth a stack trace.
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
 }
 
 func main() {
 	defaultDir := filepath.Join(os.Getenv("HOME"), ".moxie")
-	remotehost := flag.String("remotehost", "", fmt.Sprintf("Where to connect to. Required for %v mode.", modeProxy))
-	dir := flag.String("dir", defaultDir, "Where to store persistent data like history and logs.")
+	remotehost := flag.String("remotehost", "", fmt.Sprintf("Where to connect to, host:port or tls://host:port. Several comma separated name=host:port connect several sessions at once. Required for %v mode.", modeProxy))
+	session := flag.String("session", "", fmt.Sprintf("The session to show in %v mode, to send input to in %v mode, or both in %v mode. Defaults to all sessions for showing and the %#v session for input.", modeConsume, modeControl, modeWeb, common.DefaultSession))
+	dir := flag.String("dir", defaultDir, "Where to store persistent data like history, highlights, logs and recordings.")
 	mode := flag.String("mode", modeProxy, fmt.Sprintf("The run mode, one of %v.", modes))
+	useTLS := flag.Bool("tls", false, fmt.Sprintf("Whether to connect using TLS in %v mode.", modeProxy))
+	tlsInsecure := flag.Bool("tlsinsecure", false, "Whether to skip verification of TLS server certificates.")
+	tlsFingerprint := flag.String("tlsfingerprint", "", "SHA-256 fingerprint of the only TLS server certificate to accept, in hex.")
+	reconnect := flag.Int("reconnect", 0, fmt.Sprintf("How many times to try reconnecting when the connection drops in %v mode, 0 to never reconnect and -1 to never give up.", modeProxy))
+	reconnectDelay := flag.Duration("reconnectdelay", time.Second, "How long to wait before the first reconnect attempt, doubled for every failed attempt. Must be positive.")
+	reconnectMaxDelay := flag.Duration("reconnectmaxdelay", time.Minute*5, "The longest time to wait between reconnect attempts. Must be at least -reconnectdelay.")
+	charset := flag.String("charset", "", fmt.Sprintf("The charset of the server in %v mode, like ISO-8859-1 or IBM437. Defaults to UTF-8 unless negotiated by the server.", modeProxy))
+	scrollback := flag.Int("scrollback", 1<<20, fmt.Sprintf("How many bytes of scrollback to keep in memory in %v mode.", modeProxy))
+	scrollbackSpill := flag.Int64("scrollbackspill", 0, fmt.Sprintf("How many bytes of scrollback evicted from memory to keep on disk under -dir in %v mode, 0 to keep none.", modeProxy))
+	replayLines := flag.Int("replaylines", 0, fmt.Sprintf("How many lines of scrollback to show when starting in %v mode or opening the page in %v mode.", modeConsume, modeWeb))
+	replayBytes := flag.Int("replaybytes", 0, fmt.Sprintf("How many bytes of scrollback to show when starting in %v mode.", modeConsume))
+	fullscreen := flag.Int("fullscreen", 0, fmt.Sprintf("How many lines of scrollback to keep in a full screen view with paging and search in %v mode, 0 to print to the terminal instead.", modeConsume))
+	queueSize := flag.Int("queuesize", 1024, fmt.Sprintf("How many messages to queue for each consumer and subscriber in %v mode.", modeProxy))
+	overflow := flag.String("overflow", common.OverflowDropOldest, fmt.Sprintf("What to do when the queue of a consumer or subscriber is full in %v mode, one of %v. Always %v in %v mode.", modeProxy, common.OverflowPolicies, common.OverflowBlock, modeReplay))
+	promptPattern := flag.String("promptpattern", "", fmt.Sprintf("A regexp matching incomplete lines that are prompts in %v mode, for servers that do not send GA or EOR.", modeProxy))
+	promptTimeout := flag.Duration("prompttimeout", time.Second/2, fmt.Sprintf("How long an incomplete line can wait for more data before it is a prompt in %v mode, 0 to wait forever.", modeProxy))
+	commandRate := flag.Float64("commandrate", 0, fmt.Sprintf("How many commands per second to send at most in %v mode, 0 for no limit.", modeProxy))
+	promptPacing := flag.Duration("promptpacing", 0, fmt.Sprintf("How long to wait for a prompt after each command before sending the next in %v mode, 0 to not wait for prompts.", modeProxy))
+	upstream := flag.String("upstream", "", fmt.Sprintf("A socks5://[user:password@]host:port or http://[user:password@]host:port proxy to connect through in %v mode.", modeProxy))
+	listen := flag.String("listen", "", fmt.Sprintf("Where to accept telnet clients, like host:port, in %v mode. Attached clients see the output of a session and send commands to it.", modeProxy))
+	listenPassword := flag.String("listenpassword", "", "The password telnet clients must give before attaching, if any.")
+	listenReplay := flag.Int("listenreplay", 0, "How many lines of scrollback to show telnet clients when they attach.")
+	webAddr := flag.String("webaddr", "localhost:8080", fmt.Sprintf("Where to serve the browser client in %v mode. Use :port to let other machines connect.", modeWeb))
+	recordFormat := flag.String("recordformat", recorder.FormatAsciicast, fmt.Sprintf("The format of recordings in %v mode, one of %v.", modeRecord, recorder.Formats))
+	recording := flag.String("recording", "", fmt.Sprintf("The recording to play back, required in %v mode. Several comma separated name=path play back several sessions at once.", modeReplay))
+	replaySpeed := flag.Float64("replayspeed", 1, fmt.Sprintf("How many times faster than recorded to play back in %v mode, 0 for as fast as possible.", modeReplay))
+	metricsAddr := flag.String("metricsaddr", "", "Where to serve Prometheus metrics at /metrics, like localhost:9100. Not served if empty.")
+	mccp3 := flag.Bool("mccp3", false, fmt.Sprintf("Whether to compress data sent to servers supporting MCCP3 in %v mode.", modeProxy))
 
 	flag.Parse()
 
+	var registry *metrics.Registry
+	if *metricsAddr != "" {
+		registry = metrics.New()
+		if err := registry.Serve(*metricsAddr); err != nil {
+			fail("Unable to serve metrics at %v: %v", *metricsAddr, err)
+		}
+	}
+
 	switch *mode {
-	case modeProxy:
-		if *remotehost == "" {
+	case modeProxy, modeReplay:
+		if (*mode == modeProxy && *remotehost == "") || (*mode == modeReplay && *recording == "") {
 			flag.Usage()
 			return
 		}
-		proxy := proxy.New()
-		if err := proxy.Connect(*remotehost, nil); err != nil {
-			panic(err)
+		validOverflow := false
+		for _, policy := range common.OverflowPolicies {
+			validOverflow = validOverflow || policy == *overflow
+		}
+		if !validOverflow || *reconnectDelay <= 0 || *reconnectMaxDelay < *reconnectDelay {
+			flag.Usage()
+			return
+		}
+		var promptReg *regexp.Regexp
+		if *promptPattern != "" {
+			var err error
+			if promptReg, err = regexp.Compile(*promptPattern); err != nil {
+				fail("Invalid -promptpattern %#v: %v", *promptPattern, err)
+			}
+		}
+		var upstreamURL *url.URL
+		if *upstream != "" {
+			var err error
+			if upstreamURL, err = url.Parse(*upstream); err != nil {
+				fail("Invalid -upstream %#v: %v", *upstream, err)
+			}
+		}
+		policy := *overflow
+		if *mode == modeReplay {
+			// nothing played back may be dropped, or scripts would not behave the same every time
+			policy = common.OverflowBlock
+		}
+		spec := *remotehost
+		if *mode == modeReplay {
+			spec = *recording
+		}
+		proxy := proxy.New().MCCP3(*mccp3).TLS(*useTLS).TLSInsecure(*tlsInsecure).TLSFingerprint(*tlsFingerprint).Reconnect(*reconnect, *reconnectDelay, *reconnectMaxDelay).Charset(*charset).Scrollback(*scrollback).ScrollbackSpill(spillDir(*dir, spec), *scrollbackSpill).Delivery(*queueSize, policy).Prompts(promptReg, *promptTimeout).Pacing(*commandRate, *promptPacing).Upstream(upstreamURL).Listen(*listen, *listenPassword).ListenReplay(*listenReplay).Metrics(registry)
+		if *mode == modeReplay {
+			for _, played := range strings.Split(*recording, ",") {
+				name, path := common.DefaultSession, played
+				if parts := strings.SplitN(played, "=", 2); len(parts) == 2 {
+					name, path = parts[0], parts[1]
+				}
+				if err := proxy.ReplaySession(name, path, *replaySpeed); err != nil {
+					fail("Unable to replay %v: %v", path, err)
+				}
+			}
+		} else {
+			for _, remote := range strings.Split(*remotehost, ",") {
+				name, addr := common.DefaultSession, remote
+				if parts := strings.SplitN(remote, "=", 2); len(parts) == 2 {
+					name, addr = parts[0], parts[1]
+				}
+				if err := proxy.ConnectSession(name, addr); err != nil {
+					fail("Unable to connect %v to %v: %v", name, addr, err)
+				}
+			}
 		}
 		if err := proxy.Publish(struct{}{}, nil); err != nil {
 			panic(err)
 		}
 	case modeConsume:
-		consumer := consumer.New()
+		consumer := consumer.New().Dir(*dir).Session(*session).Replay(*replayLines, *replayBytes).Fullscreen(*fullscreen).Metrics(registry)
 		if err := consumer.Publish(struct{}{}, nil); err != nil {
 			panic(err)
 		}
 	case modeControl:
-		controller := controller.New().Dir(*dir)
+		controller := controller.New().Dir(*dir).Session(*session).Metrics(registry)
 		if err := controller.Publish(struct{}{}, nil); err != nil {
 			panic(err)
 		}
 		if err := controller.Control(struct{}{}, nil); err != nil {
 			panic(err)
 		}
+	case modeWeb:
+		web := web.New().Dir(*dir).Session(*session).Addr(*webAddr).Replay(*replayLines).Metrics(registry)
+		if err := web.Publish(struct{}{}, nil); err != nil {
+			panic(err)
+		}
+	case modeRecord:
+		validFormat := false
+		for _, format := range recorder.Formats {
+			validFormat = validFormat || format == *recordFormat
+		}
+		if !validFormat {
+			flag.Usage()
+			return
+		}
+		recorder := recorder.New().Dir(filepath.Join(*dir, "recordings")).Format(*recordFormat).Metrics(registry)
+		if err := recorder.Publish(struct{}{}, nil); err != nil {
+			panic(err)
+		}
 	case modeLog:
-		logger := logger.New()
+		logger := logger.New().Metrics(registry)
 		if err := logger.Publish(struct{}{}, nil); err != nil {
 			return
 		}
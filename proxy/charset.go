@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/zond/moxie/common"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+const (
+	charsetRequest  = 1
+	charsetAccepted = 2
+	charsetRejected = 3
+	utf8Charset     = "UTF-8"
+)
+
+// lookupCharset returns nil for UTF-8, since the proxy and everything attached to it already speaks UTF-8.
+func lookupCharset(name string) (result encoding.Encoding, err error) {
+	if name == "" || strings.EqualFold(name, utf8Charset) || strings.EqualFold(name, "UTF8") {
+		return
+	}
+	if result, err = ianaindex.IANA.Encoding(name); err != nil {
+		return
+	}
+	if result == nil {
+		err = fmt.Errorf("Unsupported charset %#v", name)
+		return
+	}
+	return
+}
+
+// charsetDecoder converts a stream to UTF-8, keeping incomplete multi byte sequences until the next chunk arrives.
+type charsetDecoder struct {
+	encoding    encoding.Encoding
+	transformer transform.Transformer
+	pending     []byte
+}
+
+func newCharsetDecoder(enc encoding.Encoding) *charsetDecoder {
+	return &charsetDecoder{
+		encoding:    enc,
+		transformer: enc.NewDecoder(),
+	}
+}
+
+func (self *charsetDecoder) decode(b []byte) (result []byte) {
+	src := append(self.pending, b...)
+	self.pending = nil
+	buf := make([]byte, len(src)*4+16)
+	for len(src) > 0 {
+		written, read, err := self.transformer.Transform(buf, src, false)
+		result = append(result, buf[:written]...)
+		src = src[read:]
+		if err == transform.ErrShortSrc {
+			self.pending = append([]byte{}, src...)
+			return
+		} else if err != nil && err != transform.ErrShortDst {
+			// not decodable, pass the rest through rather than lose it
+			result = append(result, src...)
+			return
+		}
+	}
+	return
+}
+
+func (self *Proxy) Charset(name string) *Proxy {
+	self.charset = name
+	return self
+}
+
+func (self *session) setCharset(name string) (err error) {
+	enc, err := lookupCharset(name)
+	if err != nil {
+		return
+	}
+	self.lock.Lock()
+	self.activeCharset, self.encoding = name, enc
+	self.lock.Unlock()
+	self.log(fmt.Sprintf("Using charset %v", name))
+	return
+}
+
+func (self *Proxy) ProxySetCharset(charset common.SessionCharset, unused *struct{}) (err error) {
+	sess, err := self.session(charset.Session)
+	if err != nil {
+		return
+	}
+	return sess.setCharset(charset.Charset)
+}
+
+func (self *Proxy) ProxyCharset(name string, result *string) (err error) {
+	sess, err := self.session(name)
+	if err != nil {
+		return
+	}
+	sess.lock.RLock()
+	defer sess.lock.RUnlock()
+	*result = sess.activeCharset
+	if *result == "" {
+		*result = utf8Charset
+	}
+	return
+}
+
+func (self *session) decode(decoder **charsetDecoder, b []byte) []byte {
+	self.lock.RLock()
+	enc := self.encoding
+	self.lock.RUnlock()
+	if enc == nil {
+		*decoder = nil
+		return b
+	}
+	if *decoder == nil || (*decoder).encoding != enc {
+		*decoder = newCharsetDecoder(enc)
+	}
+	return (*decoder).decode(b)
+}
+
+func (self *session) encode(s string) (result []byte, err error) {
+	self.lock.RLock()
+	enc := self.encoding
+	self.lock.RUnlock()
+	if enc == nil {
+		result = []byte(s)
+		return
+	}
+	return encoding.ReplaceUnsupported(enc.NewEncoder()).Bytes([]byte(s))
+}
+
+// chooseCharset picks the configured charset if offered, otherwise UTF-8, otherwise the first one we support.
+func (self *session) chooseCharset(offered []string) (result string, found bool) {
+	preferred := []string{utf8Charset}
+	if self.proxy.charset != "" {
+		preferred = append([]string{self.proxy.charset}, preferred...)
+	}
+	for _, want := range preferred {
+		for _, name := range offered {
+			if strings.EqualFold(name, want) {
+				return name, true
+			}
+		}
+	}
+	for _, name := range offered {
+		// lookupCharset takes an empty name to mean UTF-8, but nothing was offered
+		if name == "" {
+			continue
+		}
+		if _, err := lookupCharset(name); err == nil {
+			return name, true
+		}
+	}
+	return
+}
+
+func (self *session) rejectCharset(reason string) error {
+	self.log(reason)
+	return self.write(common.TelnetSubnegotiate(common.TelnetOptionCharset, []byte{charsetRejected}))
+}
+
+func (self *session) handleCharset(data []byte) (err error) {
+	if len(data) < 1 || data[0] != charsetRequest {
+		return
+	}
+	data = data[1:]
+	ttable := []byte("[TTABLE]")
+	if bytes.HasPrefix(data, ttable) {
+		// the marker is followed by a version byte before the separator
+		if len(data) <= len(ttable) {
+			return self.rejectCharset("Got a truncated charset request")
+		}
+		data = data[len(ttable)+1:]
+	}
+	if len(data) < 2 {
+		return self.rejectCharset("Got a charset request offering nothing")
+	}
+	offered := strings.Split(string(data[1:]), string(data[:1]))
+	name, found := self.chooseCharset(offered)
+	if !found {
+		return self.rejectCharset(fmt.Sprintf("None of the offered charsets %v are supported", offered))
+	}
+	if err = self.write(common.TelnetSubnegotiate(common.TelnetOptionCharset, append([]byte{charsetAccepted}, []byte(name)...))); err != nil {
+		return
+	}
+	return self.setCharset(name)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/zond/moxie/common"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+// pipeSession returns a session connected to the returned end of a pipe.
+func pipeSession(t *testing.T, proxy *Proxy) (*session, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	sess := newSession(proxy, "test")
+	sess.conn = local
+	return sess, remote
+}
+
+func TestChooseCharset(t *testing.T) {
+	for _, tc := range []struct {
+		configured string
+		offered    []string
+		want       string
+		found      bool
+	}{
+		{"", []string{"ISO-8859-1", "utf-8"}, "utf-8", true},
+		{"ISO-8859-1", []string{"UTF-8", "iso-8859-1"}, "iso-8859-1", true},
+		{"", []string{"NONSENSE", "ISO-8859-1"}, "ISO-8859-1", true},
+		{"", []string{"NONSENSE"}, "", false},
+		{"", []string{""}, "", false},
+	} {
+		sess := newSession(New().Charset(tc.configured), "test")
+		if got, found := sess.chooseCharset(tc.offered); got != tc.want || found != tc.found {
+			t.Errorf("Wanted %#v, %v for %v offering %v, got %#v, %v", tc.want, tc.found, tc.configured, tc.offered, got, found)
+		}
+	}
+}
+
+func TestHandleCharset(t *testing.T) {
+	rejected := common.TelnetSubnegotiate(common.TelnetOptionCharset, []byte{charsetRejected})
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		reply   []byte
+		charset string
+	}{
+		{"accepted", []byte("\x01;ISO-8859-1;UTF-8"), common.TelnetSubnegotiate(common.TelnetOptionCharset, []byte("\x02UTF-8")), "UTF-8"},
+		{"ttable", []byte("\x01[TTABLE]\x01 ISO-8859-1"), common.TelnetSubnegotiate(common.TelnetOptionCharset, []byte("\x02ISO-8859-1")), "ISO-8859-1"},
+		{"truncated ttable", []byte("\x01[TTABLE]"), rejected, ""},
+		{"ttable without charsets", []byte("\x01[TTABLE]\x01"), rejected, ""},
+		{"empty separator", []byte("\x01"), rejected, ""},
+		{"separator only", []byte("\x01;"), rejected, ""},
+		{"unknown charset", []byte("\x01;NONSENSE"), rejected, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sess, remote := pipeSession(t, New())
+			done := make(chan error, 1)
+			go func() {
+				done <- sess.handleCharset(tc.data)
+			}()
+			buf := make([]byte, 64)
+			n, err := remote.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], tc.reply) {
+				t.Errorf("Wanted reply %q, got %q", tc.reply, buf[:n])
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if sess.activeCharset != tc.charset {
+				t.Errorf("Wanted charset %#v, got %#v", tc.charset, sess.activeCharset)
+			}
+		})
+	}
+}
+
+func TestCharsetDecoder(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		encoding encoding.Encoding
+		chunks   []string
+		want     string
+	}{
+		{"latin1", charmap.ISO8859_1, []string{"caf\xe9"}, "café"},
+		{"empty", charmap.ISO8859_1, []string{""}, ""},
+		{"shift jis", japanese.ShiftJIS, []string{"\x93\xfa"}, "日"},
+		{"shift jis split", japanese.ShiftJIS, []string{"a\x93", "\xfab"}, "a日b"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			decoder := newCharsetDecoder(tc.encoding)
+			got := []byte{}
+			for _, chunk := range tc.chunks {
+				got = append(got, decoder.decode([]byte(chunk))...)
+			}
+			if string(got) != tc.want {
+				t.Errorf("Wanted %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+// Pacing limits how fast queued commands are sent to each session. rate is the max number of commands per second, and
+// 0 means no limit. promptWait is how long to wait for a prompt after a command before sending the next one, and 0
+// means not waiting for prompts at all.
+func (self *Proxy) Pacing(rate float64, promptWait time.Duration) *Proxy {
+	self.commandRate = rate
+	self.promptWait = promptWait
+	return self
+}
+
+// prompted tells the command queue of the session that the server is ready for the next command.
+func (self *Proxy) prompted(name string) {
+	sess, err := self.session(name)
+	if err != nil {
+		return
+	}
+	select {
+	case sess.prompted <- struct{}{}:
+	default:
+	}
+}
+
+func (self *session) queueCommand(b []byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.conn == nil && !self.replaying {
+		err = fmt.Errorf("%v is not connected", self.name)
+		return
+	}
+	self.commands = append(self.commands, common.Chunk{
+		Session: self.name,
+		Data:    b,
+		Secret:  self.telnetState(common.TelnetOptionEcho).Remote,
+	})
+	select {
+	case self.commandSignal <- struct{}{}:
+	default:
+	}
+	return
+}
+
+func (self *session) popCommand() (result common.Chunk, found bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.commands) == 0 {
+		return
+	}
+	result, found = self.commands[0], true
+	self.commands = self.commands[1:]
+	return
+}
+
+// pace waits until the next command may be sent.
+func (self *session) pace() {
+	self.lock.RLock()
+	last := self.lastCommand
+	self.lock.RUnlock()
+	if last.IsZero() {
+		return
+	}
+	if rate := self.proxy.commandRate; rate > 0 {
+		if wait := last.Add(time.Duration(float64(time.Second) / rate)).Sub(time.Now()); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	if self.proxy.promptWait > 0 {
+		select {
+		case <-self.prompted:
+		case <-time.After(self.proxy.promptWait):
+			self.log(fmt.Sprintf("No prompt within %v, sending next command anyway", self.proxy.promptWait))
+		}
+	}
+}
+
+func (self *session) sendCommands() {
+	for range self.commandSignal {
+		for {
+			self.lock.RLock()
+			waiting := len(self.commands) > 0
+			self.lock.RUnlock()
+			if !waiting {
+				break
+			}
+			// pace before popping, so that commands flushed while waiting are never sent
+			self.pace()
+			command, found := self.popCommand()
+			if !found {
+				break
+			}
+			if err := self.transmit(command.Data, command.Secret); err != nil {
+				self.log(fmt.Sprintf("Unable to send %#v: %v", string(command.Redact().Data), err))
+			}
+		}
+	}
+}
+
+func (self *Proxy) ProxyCommandQueue(name string, result *[]common.Chunk) (err error) {
+	sess, err := self.session(name)
+	if err != nil {
+		return
+	}
+	sess.lock.RLock()
+	defer sess.lock.RUnlock()
+	*result = nil
+	for _, command := range sess.commands {
+		*result = append(*result, command.Redact())
+	}
+	return
+}
+
+// ProxyFlushCommandQueue drops the queued commands of the named session, and returns them.
+func (self *Proxy) ProxyFlushCommandQueue(name string, result *[]common.Chunk) (err error) {
+	sess, err := self.session(name)
+	if err != nil {
+		return
+	}
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	*result = nil
+	for _, command := range sess.commands {
+		*result = append(*result, command.Redact())
+	}
+	sess.commands = nil
+	return
+}
+
+// ProxyTransmitNow sends the chunk right away, ahead of any queued commands and without pacing.
+func (self *Proxy) ProxyTransmitNow(chunk common.Chunk, unused *struct{}) (err error) {
+	sess, err := self.session(chunk.Session)
+	if err != nil {
+		return
+	}
+	return sess.transmit(chunk.Data, sess.masked())
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+func TestCommandRate(t *testing.T) {
+	proxy := New().Pacing(20, 0)
+	server := connectServer(t, proxy)
+	started := time.Now()
+	transmit(t, proxy, "1\n", "2\n", "3\n", "4\n", "5\n")
+	expectBytes(t, server, []byte("1\n2\n3\n4\n5\n"))
+	// the first command goes right away, and the rest 50ms apart
+	if elapsed := time.Now().Sub(started); elapsed < 190*time.Millisecond {
+		t.Fatalf("Wanted the commands paced, sent them all in %v", elapsed)
+	}
+}
+
+func TestCommandPromptWait(t *testing.T) {
+	proxy := New().Pacing(0, 5*time.Second)
+	server := connectServer(t, proxy)
+	go proxy.consume()
+	transmit(t, proxy, "look\n", "north\n")
+	expectBytes(t, server, []byte("look\n"))
+	expectNothing(t, server, time.Second/10)
+	if _, err := server.Write([]byte("You see nothing.\r\nhp> \xff\xf9")); err != nil {
+		t.Fatal(err)
+	}
+	expectBytes(t, server, []byte("north\n"))
+}
+
+func TestCommandQueue(t *testing.T) {
+	proxy := New().Pacing(0, 5*time.Second)
+	server := connectServer(t, proxy)
+	go proxy.consume()
+	transmit(t, proxy, "look\n", "north\n", "south\n")
+	expectBytes(t, server, []byte("look\n"))
+	queued := []common.Chunk{}
+	if err := proxy.ProxyCommandQueue("", &queued); err != nil {
+		t.Fatal(err)
+	}
+	if len(queued) != 2 || string(queued[0].Data) != "north\n" || string(queued[1].Data) != "south\n" {
+		t.Fatalf("Wanted north and south queued, got %+v", queued)
+	}
+	// sent right away, ahead of the queue
+	if err := proxy.ProxyTransmitNow(common.Chunk{Data: []byte("flee\n")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectBytes(t, server, []byte("flee\n"))
+	flushed := []common.Chunk{}
+	if err := proxy.ProxyFlushCommandQueue("", &flushed); err != nil {
+		t.Fatal(err)
+	}
+	if len(flushed) != 2 {
+		t.Fatalf("Wanted the queued commands flushed, got %+v", flushed)
+	}
+	if _, err := server.Write([]byte("hp> \xff\xf9")); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, server, time.Second/5)
+}
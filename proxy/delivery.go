@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zond/mdnsrpc"
+	"github.com/zond/moxie/common"
+)
+
+const (
+	defaultQueueSize = 1024
+)
+
+type delivery struct {
+	method string
+	arg    interface{}
+	queued time.Time
+}
+
+// deliveryQueue sends messages to one consumer or subscriber from its own goroutine, so that a slow client only delays
+// itself. Local queues belong to clients attached directly to the proxy instead of published with mdnsrpc.
+type deliveryQueue struct {
+	call    func(method string, arg interface{}) error
+	local   bool
+	queue   chan delivery
+	stop    chan struct{}
+	stats   common.DeliveryStats
+	current time.Time
+	lock    *sync.Mutex
+}
+
+// Delivery sets the number of messages queued for each consumer and subscriber, and what to do when a queue is full.
+func (self *Proxy) Delivery(queueSize int, overflow string) *Proxy {
+	self.queueSize = queueSize
+	self.overflow = overflow
+	return self
+}
+
+func newDeliveryQueue(service, addr string, call func(string, interface{}) error, size int) (result *deliveryQueue) {
+	result = &deliveryQueue{
+		call:  call,
+		queue: make(chan delivery, size),
+		stop:  make(chan struct{}),
+		stats: common.DeliveryStats{
+			Service:  service,
+			Addr:     addr,
+			Capacity: size,
+		},
+		lock: &sync.Mutex{},
+	}
+	go result.work()
+	return
+}
+
+func (self *deliveryQueue) work() {
+	for {
+		select {
+		case <-self.stop:
+			return
+		case d := <-self.queue:
+			self.lock.Lock()
+			self.current = d.queued
+			self.lock.Unlock()
+			started := time.Now()
+			err := self.call(d.method, d.arg)
+			self.lock.Lock()
+			self.current = time.Time{}
+			self.stats.LastLatency = time.Now().Sub(started)
+			if err != nil {
+				self.stats.Failed++
+			} else {
+				self.stats.Delivered++
+			}
+			self.lock.Unlock()
+			if err != nil {
+				// not Log, since that would deliver the error to the failing subscriber again
+				log.Printf("Unable to deliver %v to %v: %v", d.method, self.stats.Addr, err)
+			}
+		}
+	}
+}
+
+// remove stops the queue, dropping anything still in it.
+func (self *deliveryQueue) remove() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.stats.Removed {
+		self.stats.Removed = true
+		close(self.stop)
+	}
+}
+
+func (self *deliveryQueue) removed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.stats.Removed
+}
+
+func (self *deliveryQueue) enqueue(d delivery, overflow string) (full bool) {
+	switch overflow {
+	case common.OverflowBlock:
+		select {
+		case self.queue <- d:
+		case <-self.stop:
+		}
+	case common.OverflowDropSubscriber:
+		select {
+		case self.queue <- d:
+		default:
+			full = true
+		}
+	default:
+		for {
+			select {
+			case self.queue <- d:
+				return
+			default:
+			}
+			select {
+			case <-self.queue:
+				self.lock.Lock()
+				self.stats.Dropped++
+				self.lock.Unlock()
+			default:
+			}
+		}
+	}
+	return
+}
+
+func (self *deliveryQueue) snapshot() (result common.DeliveryStats) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result = self.stats
+	result.Queued = len(self.queue)
+	if !self.current.IsZero() {
+		result.Lag = time.Now().Sub(self.current)
+	}
+	return
+}
+
+// queuesFor returns the delivery queues of the currently published clients of service, creating queues for new clients
+// and removing the queues of clients that are gone.
+func (self *Proxy) queuesFor(service string) (result []*deliveryQueue, err error) {
+	clients, err := mdnsrpc.LookupAll(service)
+	if err != nil {
+		if _, ok := err.(mdnsrpc.NoSuchService); !ok {
+			return
+		}
+		err = nil
+	}
+	self.queueLock.Lock()
+	defer self.queueLock.Unlock()
+	found := map[string]bool{}
+	for _, client := range clients {
+		key := fmt.Sprintf("%v/%v", service, client.Addr)
+		found[key] = true
+		queue, exists := self.queues[key]
+		if !exists {
+			log.Printf("New %v found at %v", service, client.Addr)
+			client := client
+			queue = newDeliveryQueue(service, client.Addr.String(), func(method string, arg interface{}) error {
+				return self.metrics.Call(client, method, arg, nil)
+			}, self.queueSize)
+			self.queues[key] = queue
+		}
+		// queues dropped for overflowing stay until their client is gone, so they are not recreated
+		if !queue.removed() {
+			result = append(result, queue)
+		}
+	}
+	for key, queue := range self.queues {
+		if queue.stats.Service != service {
+			continue
+		}
+		if queue.local {
+			if !queue.removed() {
+				result = append(result, queue)
+			}
+		} else if !found[key] {
+			queue.remove()
+			delete(self.queues, key)
+		}
+	}
+	return
+}
+
+// addLocalQueue makes deliveries to service also go to call, until removeLocalQueue is called with the returned queue.
+func (self *Proxy) addLocalQueue(service, addr string, call func(string, interface{}) error) (result *deliveryQueue) {
+	result = newDeliveryQueue(service, addr, call, self.queueSize)
+	result.local = true
+	self.queueLock.Lock()
+	defer self.queueLock.Unlock()
+	self.queues[fmt.Sprintf("%v/%v", service, addr)] = result
+	return
+}
+
+func (self *Proxy) removeLocalQueue(queue *deliveryQueue) {
+	queue.remove()
+	self.queueLock.Lock()
+	defer self.queueLock.Unlock()
+	delete(self.queues, fmt.Sprintf("%v/%v", queue.stats.Service, queue.stats.Addr))
+}
+
+// deliver queues a call of method with arg to every client of service, without waiting for the calls to happen.
+func (self *Proxy) deliver(service, method string, arg interface{}) {
+	queues, err := self.queuesFor(service)
+	if err != nil {
+		log.Printf("Unable to find %v: %v", service, err)
+		return
+	}
+	d := delivery{
+		method: method,
+		arg:    arg,
+		queued: time.Now(),
+	}
+	for _, queue := range queues {
+		if queue.enqueue(d, self.overflow) {
+			log.Printf("Delivery queue for %v full, dropping it", queue.stats.Addr)
+			queue.remove()
+		}
+	}
+}
+
+func (self *Proxy) ProxyDeliveryStats(unused struct{}, result *[]common.DeliveryStats) (err error) {
+	self.queueLock.Lock()
+	defer self.queueLock.Unlock()
+	*result = nil
+	for _, queue := range self.queues {
+		*result = append(*result, queue.snapshot())
+	}
+	sort.Slice(*result, func(i, j int) bool {
+		if (*result)[i].Service != (*result)[j].Service {
+			return (*result)[i].Service < (*result)[j].Service
+		}
+		return (*result)[i].Addr < (*result)[j].Addr
+	})
+	return
+}
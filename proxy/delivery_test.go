@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+const testService = "Test"
+
+// slowClient takes no deliveries until released, and tells what it was given.
+type slowClient struct {
+	got     chan interface{}
+	release chan struct{}
+}
+
+func newSlowClient() *slowClient {
+	return &slowClient{
+		got:     make(chan interface{}, 16),
+		release: make(chan struct{}),
+	}
+}
+
+func (self *slowClient) call(method string, arg interface{}) error {
+	self.got <- arg
+	<-self.release
+	return nil
+}
+
+func (self *slowClient) expect(t *testing.T, expected ...interface{}) {
+	t.Helper()
+	for _, want := range expected {
+		select {
+		case got := <-self.got:
+			if got != want {
+				t.Fatalf("Wanted %v delivered, got %v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %v", want)
+		}
+	}
+}
+
+// slowQueue makes proxy deliver to a slow client with a queue of size deliveries, the first of which the client is
+// already stuck on.
+func slowQueue(t *testing.T, size int, overflow string) (*Proxy, *slowClient, *deliveryQueue) {
+	proxy := New().Delivery(size, overflow)
+	client := newSlowClient()
+	queue := proxy.addLocalQueue(testService, "slow", client.call)
+	t.Cleanup(func() {
+		proxy.removeLocalQueue(queue)
+	})
+	proxy.deliver(testService, "Test.Deliver", "first")
+	client.expect(t, "first")
+	return proxy, client, queue
+}
+
+func TestDeliveryDropOldest(t *testing.T) {
+	proxy, client, queue := slowQueue(t, 2, common.OverflowDropOldest)
+	for _, arg := range []string{"second", "third", "fourth"} {
+		proxy.deliver(testService, "Test.Deliver", arg)
+	}
+	if stats := queue.snapshot(); stats.Dropped != 1 || stats.Queued != 2 || stats.Removed {
+		t.Fatalf("Wanted the oldest dropped, got %+v", stats)
+	}
+	close(client.release)
+	client.expect(t, "third", "fourth")
+}
+
+func TestDeliveryDropSubscriber(t *testing.T) {
+	proxy, client, queue := slowQueue(t, 1, common.OverflowDropSubscriber)
+	proxy.deliver(testService, "Test.Deliver", "second")
+	if queue.removed() {
+		t.Fatal("Wanted the queue kept while not full")
+	}
+	proxy.deliver(testService, "Test.Deliver", "third")
+	if !queue.removed() {
+		t.Fatal("Wanted the queue dropped when full")
+	}
+	queues, err := proxy.queuesFor(testService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queues) != 0 {
+		t.Fatalf("Wanted no deliveries to the dropped queue, got %v queues", len(queues))
+	}
+	close(client.release)
+}
+
+func TestDeliveryBlock(t *testing.T) {
+	proxy, client, _ := slowQueue(t, 1, common.OverflowBlock)
+	proxy.deliver(testService, "Test.Deliver", "second")
+	done := make(chan struct{})
+	go func() {
+		proxy.deliver(testService, "Test.Deliver", "third")
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Wanted delivery to wait for the full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(client.release)
+	<-done
+	client.expect(t, "second", "third")
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+// listenLocal makes handle serve every connection to the returned local address until the test ends.
+func listenLocal(t *testing.T, handle func(net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// connectServer connects the default session of proxy to a new server, and returns the server end of the connection. The proxy doesn't
+// consume its buffer, so that tests can read what it received from it.
+func connectServer(t *testing.T, proxy *Proxy) net.Conn {
+	accepted := make(chan net.Conn, 1)
+	addr := listenLocal(t, func(conn net.Conn) {
+		accepted <- conn
+	})
+	proxy.consuming = true
+	if err := proxy.ConnectSession(common.DefaultSession, addr); err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// nextItem returns the next chunk or notification in the buffer of proxy.
+func nextItem(t *testing.T, proxy *Proxy) queued {
+	t.Helper()
+	select {
+	case item := <-proxy.buffer:
+		return item
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the buffer")
+	}
+	return queued{}
+}
+
+// nextChunk returns the next chunk in the buffer of proxy, skipping notifications.
+func nextChunk(t *testing.T, proxy *Proxy) common.Chunk {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case item := <-proxy.buffer:
+			if item.method == "" {
+				return item.chunk
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for a chunk")
+		}
+	}
+}
+
+// receivedText returns the data of the next received chunks, until there is at least length bytes of it.
+func receivedText(t *testing.T, proxy *Proxy, length int) string {
+	t.Helper()
+	result := []byte{}
+	for len(result) < length {
+		if chunk := nextChunk(t, proxy); !chunk.Transmitted {
+			result = append(result, chunk.Data...)
+		}
+	}
+	return string(result)
+}
+
+// subscribe makes proxy deliver the arguments of its notifications to subscribers calling method to the returned
+// channel.
+func subscribe(t *testing.T, proxy *Proxy, method string) chan interface{} {
+	args := make(chan interface{}, 64)
+	queue := proxy.addLocalQueue(common.Subscriber, method, func(called string, arg interface{}) error {
+		if called == method {
+			args <- arg
+		}
+		return nil
+	})
+	t.Cleanup(func() {
+		proxy.removeLocalQueue(queue)
+	})
+	return args
+}
+
+// nextArg returns the next argument delivered to args.
+func nextArg(t *testing.T, args chan interface{}) interface{} {
+	t.Helper()
+	select {
+	case arg := <-args:
+		return arg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a notification")
+	}
+	return nil
+}
+
+// waitFor fails unless cond turns true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	timeout := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(timeout) {
+			t.Fatalf("Timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// expectNothing fails if the server gets anything within wait.
+func expectNothing(t *testing.T, server net.Conn, wait time.Duration) {
+	t.Helper()
+	if err := server.SetReadDeadline(time.Now().Add(wait)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if n, err := server.Read(buf); err == nil {
+		t.Fatalf("Wanted nothing sent, got %q", buf[:n])
+	}
+	if err := server.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// transmit sends commands to the default session of proxy.
+func transmit(t *testing.T, proxy *Proxy, commands ...string) {
+	t.Helper()
+	for _, command := range commands {
+		if err := proxy.ProxyTransmit(common.Chunk{Data: []byte(command)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func expectBytes(t *testing.T, r io.Reader, expected []byte) {
+	t.Helper()
+	got := make([]byte, len(expected))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("Wanted %q, got %q: %v", expected, got, err)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("Wanted %q, got %q", expected, got)
+	}
+}
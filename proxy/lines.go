@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+const (
+	defaultPromptTimeout = time.Second / 2
+	promptTick           = time.Second / 10
+)
+
+type framer struct {
+	*common.LineFramer
+	updated time.Time
+}
+
+// Prompts makes incomplete lines matching pattern prompts, as well as incomplete lines that got no more data for
+// timeout. A nil pattern or a 0 timeout disables that kind of detection, while GA and EOR always end prompts.
+func (self *Proxy) Prompts(pattern *regexp.Regexp, timeout time.Duration) *Proxy {
+	self.promptPattern = pattern
+	self.promptTimeout = timeout
+	return self
+}
+
+func (self *Proxy) deliverLines(lines []common.Line) {
+	for _, line := range lines {
+		self.deliver(common.Subscriber, common.SubscriberLine, line)
+		if line.Prompt {
+			self.prompted(line.Session)
+		}
+	}
+}
+
+// frame is only called from the consume goroutine, which owns framers.
+func (self *Proxy) frame(framers map[string]*framer, chunk common.Chunk) {
+	f, found := framers[chunk.Session]
+	if !found {
+		f = &framer{
+			LineFramer: &common.LineFramer{
+				PromptPattern: self.promptPattern,
+			},
+		}
+		framers[chunk.Session] = f
+	}
+	f.updated = time.Now()
+	self.deliverLines(f.Frame(chunk))
+}
+
+func (self *Proxy) flushPrompts(framers map[string]*framer) {
+	if self.promptTimeout == 0 {
+		return
+	}
+	for _, f := range framers {
+		if f.Pending() && time.Now().Sub(f.updated) > self.promptTimeout {
+			self.deliverLines(f.Flush())
+		}
+	}
+}
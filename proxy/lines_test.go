@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+// subscribeLines makes proxy deliver the lines it frames to the returned channel.
+func subscribeLines(t *testing.T, proxy *Proxy) chan common.Line {
+	lines := make(chan common.Line, 16)
+	queue := proxy.addLocalQueue(common.Subscriber, "lines", func(method string, arg interface{}) error {
+		if method == common.SubscriberLine {
+			lines <- arg.(common.Line)
+		}
+		return nil
+	})
+	t.Cleanup(func() {
+		proxy.removeLocalQueue(queue)
+	})
+	return lines
+}
+
+func TestFraming(t *testing.T) {
+	proxy := New().Prompts(regexp.MustCompile("Password: $"), time.Second/10)
+	lines := subscribeLines(t, proxy)
+	server := connectServer(t, proxy)
+	go proxy.consume()
+	for _, test := range []struct {
+		writes   []string
+		expected []common.Line
+	}{
+		{[]string{"one\r\ntwo\r\nhp> \xff\xf9"}, []common.Line{{Text: "one"}, {Text: "two"}, {Text: "hp> ", Prompt: true}}},
+		{[]string{"split li", "ne\r\n"}, []common.Line{{Text: "split line"}}},
+		{[]string{"Password: "}, []common.Line{{Text: "Password: ", Prompt: true}}},
+		// nothing more arrives for longer than the prompt timeout
+		{[]string{"What now?"}, []common.Line{{Text: "What now?", Prompt: true}}},
+	} {
+		for _, write := range test.writes {
+			if _, err := server.Write([]byte(write)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, expected := range test.expected {
+			select {
+			case line := <-lines:
+				if line.Session != common.DefaultSession || line.Text != expected.Text || line.Prompt != expected.Prompt {
+					t.Fatalf("Wanted %+v, got %+v", expected, line)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for %+v", expected)
+			}
+		}
+	}
+	select {
+	case line := <-lines:
+		t.Fatalf("Wanted no more lines, got %+v", line)
+	case <-time.After(time.Second / 5):
+	}
+}
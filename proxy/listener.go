@@ -0,0 +1,360 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+const (
+	listenWriteTimeout = 30 * time.Second
+	// clients sending longer lines than this are disconnected, so that one never ending a line can't make us hold on
+	// to everything it sends
+	maxListenLineLength = 4096
+)
+
+// options we are willing to perform for attached clients, except ECHO which follows the server
+var listenLocalOptions = map[byte]bool{
+	common.TelnetOptionSuppressGoAhead: true,
+	common.TelnetOptionEndOfRecord:     true,
+}
+
+// options we want attached clients to perform
+var listenRemoteOptions = map[byte]bool{
+	common.TelnetOptionNAWS: true,
+}
+
+// Listen makes the proxy accept ordinary telnet clients at addr once published. Every attached client sees the output
+// of a session and sends its input as commands to it. With a password, clients must give it before attaching.
+func (self *Proxy) Listen(addr, password string) *Proxy {
+	self.listenAddr = addr
+	self.listenPassword = password
+	return self
+}
+
+// ListenReplay makes attaching telnet clients start by showing the last lines of scrollback of their session.
+func (self *Proxy) ListenReplay(lines int) *Proxy {
+	self.listenReplay = lines
+	return self
+}
+
+func (self *Proxy) listen() (err error) {
+	if self.listenAddr == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", self.listenAddr)
+	if err != nil {
+		return
+	}
+	self.Log(fmt.Sprintf("Listening for telnet clients at %v", listener.Addr()), nil)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				self.Log(fmt.Sprintf("Unable to accept telnet clients: %v", err), nil)
+				return
+			}
+			go newTelnetClient(self, conn).serve()
+		}
+	}()
+	return
+}
+
+// telnetClient is an ordinary MUD client attached to the proxy, acting as both consumer and transmitter of a session.
+type telnetClient struct {
+	proxy         *Proxy
+	conn          net.Conn
+	addr          string
+	authenticated bool
+	session       string
+	queue         *deliveryQueue
+	replayed      uint64
+	input         []byte
+	local         map[byte]bool
+	remote        map[byte]bool
+	lock          *sync.Mutex
+}
+
+func newTelnetClient(proxy *Proxy, conn net.Conn) *telnetClient {
+	return &telnetClient{
+		proxy:         proxy,
+		conn:          conn,
+		addr:          conn.RemoteAddr().String(),
+		authenticated: proxy.listenPassword == "",
+		local:         map[byte]bool{},
+		remote:        map[byte]bool{},
+		lock:          &sync.Mutex{},
+	}
+}
+
+// write sends b to the client. Callers must hold the lock.
+func (self *telnetClient) write(b []byte) (err error) {
+	if err = self.conn.SetWriteDeadline(time.Now().Add(listenWriteTimeout)); err != nil {
+		return
+	}
+	return writeAll(self.conn, b)
+}
+
+// writeText sends text followed by the prompt marker the client agreed to, if prompt. Callers must hold the lock.
+func (self *telnetClient) writeText(text []byte, prompt bool) (err error) {
+	if err = self.write(common.TelnetEscape(text)); err != nil {
+		return
+	}
+	if prompt {
+		if self.local[common.TelnetOptionEndOfRecord] {
+			return self.write([]byte{common.TelnetIAC, common.TelnetEOR})
+		}
+		if !self.local[common.TelnetOptionSuppressGoAhead] {
+			return self.write([]byte{common.TelnetIAC, common.TelnetGA})
+		}
+	}
+	return
+}
+
+// setEcho tells the client whether we echo its input, which makes it stop echoing locally. Callers must hold the lock.
+func (self *telnetClient) setEcho(echo bool) (err error) {
+	if self.local[common.TelnetOptionEcho] == echo {
+		return
+	}
+	self.local[common.TelnetOptionEcho] = echo
+	if echo {
+		return self.write(common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionEcho))
+	}
+	return self.write(common.TelnetNegotiate(common.TelnetWONT, common.TelnetOptionEcho))
+}
+
+func (self *telnetClient) serve() {
+	self.proxy.Log(fmt.Sprintf("Telnet client connected from %v", self.addr), nil)
+	defer self.close()
+	err := self.greet()
+	parser := &common.TelnetParser{}
+	buf := make([]byte, 4096)
+	for err == nil {
+		read := 0
+		read, err = self.conn.Read(buf)
+		if read > 0 {
+			// clients never start MCCP2, so the parser always consumes everything
+			events, _ := parser.Parse(buf[:read])
+			if handleErr := self.handle(events); handleErr != nil {
+				err = handleErr
+			}
+		}
+	}
+	if err != io.EOF {
+		self.proxy.Log(fmt.Sprintf("Telnet client %v: %v", self.addr, err), nil)
+	}
+}
+
+func (self *telnetClient) greet() (err error) {
+	self.lock.Lock()
+	for option := range listenLocalOptions {
+		self.local[option] = true
+		if err = self.write(common.TelnetNegotiate(common.TelnetWILL, option)); err != nil {
+			self.lock.Unlock()
+			return
+		}
+	}
+	for option := range listenRemoteOptions {
+		self.remote[option] = true
+		if err = self.write(common.TelnetNegotiate(common.TelnetDO, option)); err != nil {
+			self.lock.Unlock()
+			return
+		}
+	}
+	if !self.authenticated {
+		if err = self.setEcho(true); err == nil {
+			err = self.writeText([]byte("Password: "), true)
+		}
+		self.lock.Unlock()
+		return
+	}
+	self.lock.Unlock()
+	return self.attach("")
+}
+
+func (self *telnetClient) close() {
+	self.lock.Lock()
+	queue := self.queue
+	self.lock.Unlock()
+	if queue != nil {
+		self.proxy.removeLocalQueue(queue)
+	}
+	self.conn.Close()
+	self.proxy.Log(fmt.Sprintf("Telnet client %v disconnected", self.addr), nil)
+}
+
+func (self *telnetClient) handle(events []common.TelnetEvent) (err error) {
+	for _, event := range events {
+		switch event.Type {
+		case common.TelnetText:
+			for _, c := range event.Data {
+				if c == '\n' {
+					line := strings.TrimSuffix(string(self.input), "\r")
+					self.input = nil
+					if err = self.handleLine(line); err != nil {
+						return
+					}
+				} else if len(self.input) >= maxListenLineLength {
+					self.lock.Lock()
+					self.writeText([]byte("\r\nLine too long.\r\n"), false)
+					self.lock.Unlock()
+					return fmt.Errorf("Line longer than %v bytes", maxListenLineLength)
+				} else {
+					self.input = append(self.input, c)
+				}
+			}
+		case common.TelnetNegotiation:
+			if err = self.negotiate(event.Verb, event.Option); err != nil {
+				return
+			}
+		case common.TelnetSubnegotiation:
+			if event.Option == common.TelnetOptionNAWS && len(event.Data) == 4 {
+				if err = self.proxy.ProxyWindowSize(common.WindowSize{
+					Source: common.WindowSizeConsumer,
+					Width:  int(event.Data[0])<<8 | int(event.Data[1]),
+					Height: int(event.Data[2])<<8 | int(event.Data[3]),
+				}, nil); err != nil {
+					self.proxy.Log(fmt.Sprintf("Unable to report window size of %v: %v", self.addr, err), nil)
+					err = nil
+				}
+			}
+		}
+	}
+	return
+}
+
+func (self *telnetClient) handleLine(line string) (err error) {
+	self.lock.Lock()
+	authenticated, attached, session := self.authenticated, self.queue != nil, self.session
+	self.lock.Unlock()
+	if !authenticated {
+		if subtle.ConstantTimeCompare([]byte(line), []byte(self.proxy.listenPassword)) != 1 {
+			self.lock.Lock()
+			self.writeText([]byte("\r\nWrong password.\r\n"), false)
+			self.lock.Unlock()
+			return fmt.Errorf("Wrong password")
+		}
+		self.lock.Lock()
+		self.authenticated = true
+		if err = self.setEcho(false); err == nil {
+			err = self.write([]byte("\r\n"))
+		}
+		self.lock.Unlock()
+		if err != nil {
+			return
+		}
+		return self.attach("")
+	}
+	if !attached {
+		return self.attach(line)
+	}
+	if transmitErr := self.proxy.ProxyTransmit(common.Chunk{
+		Session: session,
+		Data:    []byte(line + "\n"),
+	}, nil); transmitErr != nil {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		return self.writeText([]byte(transmitErr.Error()+"\r\n"), false)
+	}
+	return
+}
+
+// attach makes the client consume the named session, or asks for another name if there is no such session.
+func (self *telnetClient) attach(name string) (err error) {
+	sess, sessionErr := self.proxy.session(name)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if sessionErr != nil {
+		return self.writeText([]byte(sessionErr.Error()+"\r\nSession: "), true)
+	}
+	self.session = sess.name
+	// keep the lock until the replay is written, so that the queue can't deliver anything before it
+	self.queue = self.proxy.addLocalQueue(common.Consumer, "telnet://"+self.addr, self.deliver)
+	go func(queue *deliveryQueue) {
+		<-queue.stop
+		self.conn.Close()
+	}(self.queue)
+	self.proxy.Log(fmt.Sprintf("Telnet client %v attached to %v", self.addr, self.session), nil)
+	if self.proxy.listenReplay > 0 {
+		chunks, tailErr := self.proxy.scrollback.tail(common.ScrollbackRequest{
+			Session: self.session,
+			Lines:   self.proxy.listenReplay,
+		})
+		if tailErr != nil {
+			self.proxy.Log(fmt.Sprintf("Unable to replay scrollback to %v: %v", self.addr, tailErr), nil)
+		}
+		for _, chunk := range chunks {
+			if err = self.writeText(chunk.Data, chunk.Prompt); err != nil {
+				return
+			}
+			self.replayed = chunk.Seq
+		}
+	}
+	return self.setEcho(sess.masked())
+}
+
+// deliver is called by the delivery queue of the client.
+func (self *telnetClient) deliver(method string, arg interface{}) (err error) {
+	chunk, ok := arg.(common.Chunk)
+	if method != common.ConsumerConsume || !ok {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if chunk.Session != self.session || chunk.Seq <= self.replayed {
+		return
+	}
+	// the server changes echo before sending what should be masked, so following it here keeps the order
+	if sess, sessionErr := self.proxy.session(self.session); sessionErr == nil {
+		if err = self.setEcho(sess.masked()); err != nil {
+			return
+		}
+	}
+	return self.writeText(chunk.Data, chunk.Prompt)
+}
+
+func (self *telnetClient) negotiate(verb, option byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var reply byte
+	switch verb {
+	case common.TelnetDO:
+		if option == common.TelnetOptionEcho {
+			if !self.local[option] {
+				reply = common.TelnetWONT
+			}
+		} else if listenLocalOptions[option] {
+			if !self.local[option] {
+				self.local[option], reply = true, common.TelnetWILL
+			}
+		} else {
+			reply = common.TelnetWONT
+		}
+	case common.TelnetDONT:
+		if self.local[option] {
+			self.local[option], reply = false, common.TelnetWONT
+		}
+	case common.TelnetWILL:
+		if listenRemoteOptions[option] {
+			if !self.remote[option] {
+				self.remote[option], reply = true, common.TelnetDO
+			}
+		} else {
+			reply = common.TelnetDONT
+		}
+	case common.TelnetWONT:
+		if self.remote[option] {
+			self.remote[option], reply = false, common.TelnetDONT
+		}
+	}
+	if reply != 0 {
+		return self.write(common.TelnetNegotiate(reply, option))
+	}
+	return
+}
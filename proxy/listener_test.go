@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+// attachClient connects a new telnet client to proxy as if accepted by its listener, and returns the client end.
+func attachClient(t *testing.T, proxy *Proxy) net.Conn {
+	addr := listenLocal(t, func(conn net.Conn) {
+		newTelnetClient(proxy, conn).serve()
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readUntil reads from conn until expected has arrived, and returns everything read.
+func readUntil(t *testing.T, conn net.Conn, expected []byte) []byte {
+	t.Helper()
+	got := []byte{}
+	buf := make([]byte, 1024)
+	for !bytes.Contains(got, expected) {
+		read, err := conn.Read(buf)
+		got = append(got, buf[:read]...)
+		if err != nil {
+			t.Fatalf("Wanted %q, got %q: %v", expected, got, err)
+		}
+	}
+	return got
+}
+
+func write(t *testing.T, conn net.Conn, b []byte) {
+	t.Helper()
+	if _, err := conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListenerWrongPassword(t *testing.T) {
+	proxy := New().Listen("", "secret")
+	connectServer(t, proxy)
+	go proxy.consume()
+	client := attachClient(t, proxy)
+	got := readUntil(t, client, []byte("Password: "))
+	// the client stops echoing while the password is typed
+	if !bytes.Contains(got, common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionEcho)) {
+		t.Fatalf("Wanted echo turned on before the password, got %q", got)
+	}
+	write(t, client, []byte("guess\r\n"))
+	readUntil(t, client, []byte("Wrong password."))
+	if rest, err := io.ReadAll(client); err != nil {
+		t.Fatalf("Wanted the client disconnected, got %q, %v", rest, err)
+	}
+}
+
+func TestListenerAttach(t *testing.T) {
+	proxy := New().Listen("", "secret").ListenReplay(5)
+	server := connectServer(t, proxy)
+	go proxy.consume()
+	write(t, server, []byte("Welcome\r\n"))
+	waitFor(t, "the welcome in the scrollback", func() bool {
+		chunks, err := proxy.scrollback.tail(common.ScrollbackRequest{Session: common.DefaultSession, Lines: 5})
+		return err == nil && len(chunks) > 0
+	})
+	client := attachClient(t, proxy)
+	readUntil(t, client, []byte("Password: "))
+	write(t, client, common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionNAWS))
+	write(t, client, common.TelnetSubnegotiate(common.TelnetOptionNAWS, []byte{0, 100, 0, 40}))
+	write(t, client, []byte("secret\r\n"))
+	got := readUntil(t, client, []byte("Welcome\r\n"))
+	if !bytes.Contains(got, common.TelnetNegotiate(common.TelnetWONT, common.TelnetOptionEcho)) {
+		t.Fatalf("Wanted echo turned off after the password, got %q", got)
+	}
+	if size := proxy.windowSize(); size.Width != 100 || size.Height != 40 {
+		t.Fatalf("Wanted the size of the client, got %+v", size)
+	}
+	// the client agreed to end of record, so prompts end with EOR instead of GA
+	write(t, server, []byte("Hello\r\nhp> \xff\xf9"))
+	readUntil(t, client, []byte("Hello\r\nhp> \xff\xef"))
+	write(t, client, []byte("look\r\n"))
+	expectBytes(t, server, []byte("look\n"))
+	stats := []common.DeliveryStats{}
+	if err := proxy.ProxyDeliveryStats(struct{}{}, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("Wanted the client among the consumers, got %+v", stats)
+	}
+	client.Close()
+	waitFor(t, "the client to stop consuming", func() bool {
+		return proxy.ProxyDeliveryStats(struct{}{}, &stats) == nil && len(stats) == 0
+	})
+}
+
+func TestListenerNegotiation(t *testing.T) {
+	proxy := New()
+	connectServer(t, proxy)
+	client := attachClient(t, proxy)
+	expected := [][]byte{
+		common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionSuppressGoAhead),
+		common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionEndOfRecord),
+		common.TelnetNegotiate(common.TelnetDO, common.TelnetOptionNAWS),
+	}
+	// the options are offered in any order
+	got := []byte{}
+	buf := make([]byte, 64)
+	for _, negotiation := range expected {
+		for !bytes.Contains(got, negotiation) {
+			read, err := client.Read(buf)
+			if err != nil {
+				t.Fatalf("Wanted %q, got %q: %v", negotiation, got, err)
+			}
+			got = append(got, buf[:read]...)
+		}
+	}
+	for _, test := range []struct {
+		verb     byte
+		option   byte
+		expected []byte
+	}{
+		{common.TelnetDO, common.TelnetOptionMCCP2, common.TelnetNegotiate(common.TelnetWONT, common.TelnetOptionMCCP2)},
+		{common.TelnetWILL, common.TelnetOptionMCCP2, common.TelnetNegotiate(common.TelnetDONT, common.TelnetOptionMCCP2)},
+		{common.TelnetDONT, common.TelnetOptionEndOfRecord, common.TelnetNegotiate(common.TelnetWONT, common.TelnetOptionEndOfRecord)},
+		{common.TelnetDO, common.TelnetOptionEndOfRecord, common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionEndOfRecord)},
+	} {
+		write(t, client, common.TelnetNegotiate(test.verb, test.option))
+		readUntil(t, client, test.expected)
+	}
+}
+
+func TestListenerLineTooLong(t *testing.T) {
+	proxy := New()
+	server := connectServer(t, proxy)
+	go proxy.consume()
+	client := attachClient(t, proxy)
+	// the longest line allowed, counting the carriage return, is still sent
+	write(t, client, bytes.Repeat([]byte("x"), maxListenLineLength-1))
+	write(t, client, []byte("\r\n"))
+	expectBytes(t, server, append(bytes.Repeat([]byte("x"), maxListenLineLength-1), '\n'))
+	write(t, client, bytes.Repeat([]byte("x"), maxListenLineLength+1))
+	readUntil(t, client, []byte("Line too long."))
+	if rest, err := io.ReadAll(client); err != nil {
+		t.Fatalf("Wanted the client disconnected, got %q, %v", rest, err)
+	}
+	expectNothing(t, server, time.Second/10)
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/zlib"
+	"fmt"
+	"io"
+)
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (self *countingReader) Read(b []byte) (n int, err error) {
+	n, err = self.reader.Read(b)
+	self.count += int64(n)
+	return
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (self *countingWriter) Write(b []byte) (n int, err error) {
+	n, err = self.writer.Write(b)
+	self.count += int64(n)
+	return
+}
+
+func ratio(compressed, uncompressed int64) float64 {
+	if uncompressed == 0 {
+		return 0
+	}
+	return 100 * float64(compressed) / float64(uncompressed)
+}
+
+// inflater decompresses an MCCP2 stream. It reads from the same bufio.Reader as the uncompressed stream, which zlib
+// will not read past the end of the compressed data, so the connection can continue uncompressed afterwards.
+type inflater struct {
+	reader   io.ReadCloser
+	in       *bufio.Reader
+	counter  *countingReader
+	start    int64
+	inflated int64
+}
+
+func newInflater(in *bufio.Reader, counter *countingReader) (result *inflater, err error) {
+	result = &inflater{
+		in:      in,
+		counter: counter,
+		start:   counter.count - int64(in.Buffered()),
+	}
+	if result.reader, err = zlib.NewReader(in); err != nil {
+		return
+	}
+	return
+}
+
+func (self *inflater) Read(b []byte) (n int, err error) {
+	n, err = self.reader.Read(b)
+	self.inflated += int64(n)
+	return
+}
+
+func (self *inflater) Close() error {
+	return self.reader.Close()
+}
+
+func (self *inflater) String() string {
+	compressed := self.counter.count - int64(self.in.Buffered()) - self.start
+	return fmt.Sprintf("MCCP2 received %v compressed bytes, inflated to %v bytes (%.1f%%)", compressed, self.inflated, ratio(compressed, self.inflated))
+}
+
+type deflater struct {
+	writer   *zlib.Writer
+	counter  *countingWriter
+	deflated int64
+}
+
+func newDeflater(w io.Writer) (result *deflater) {
+	result = &deflater{
+		counter: &countingWriter{writer: w},
+	}
+	result.writer = zlib.NewWriter(result.counter)
+	return
+}
+
+func (self *deflater) Write(b []byte) (n int, err error) {
+	if n, err = self.writer.Write(b); err != nil {
+		return
+	}
+	self.deflated += int64(n)
+	if err = self.writer.Flush(); err != nil {
+		return
+	}
+	return
+}
+
+func (self *deflater) Close() error {
+	return self.writer.Close()
+}
+
+func (self *deflater) String() string {
+	return fmt.Sprintf("MCCP3 sent %v bytes, deflated to %v bytes (%.1f%%)", self.deflated, self.counter.count, ratio(self.counter.count, self.deflated))
+}
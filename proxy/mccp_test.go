@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"io"
+	"testing"
+
+	"github.com/zond/moxie/common"
+)
+
+func deflate(t *testing.T, s string) []byte {
+	buf := &bytes.Buffer{}
+	writer := zlib.NewWriter(buf)
+	if _, err := io.WriteString(writer, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMCCP2(t *testing.T) {
+	proxy := New()
+	server := connectServer(t, proxy)
+	if _, err := server.Write(common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionMCCP2)); err != nil {
+		t.Fatal(err)
+	}
+	expectBytes(t, server, common.TelnetNegotiate(common.TelnetDO, common.TelnetOptionMCCP2))
+	// the compressed stream ends in the same write as it starts, and is followed by uncompressed text
+	b := common.TelnetSubnegotiate(common.TelnetOptionMCCP2, nil)
+	b = append(b, deflate(t, "compressed\n")...)
+	b = append(b, "plain again\n"...)
+	if _, err := server.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if text := receivedText(t, proxy, len("compressed\nplain again\n")); text != "compressed\nplain again\n" {
+		t.Fatalf("Got %q", text)
+	}
+}
+
+func TestMCCP3(t *testing.T) {
+	proxy := New().MCCP3(true)
+	server := connectServer(t, proxy)
+	in := bufio.NewReader(server)
+	if _, err := server.Write(common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionMCCP3)); err != nil {
+		t.Fatal(err)
+	}
+	expectBytes(t, in, common.TelnetNegotiate(common.TelnetDO, common.TelnetOptionMCCP3))
+	expectBytes(t, in, common.TelnetSubnegotiate(common.TelnetOptionMCCP3, nil))
+	if err := proxy.ProxyTransmit(common.Chunk{Data: []byte("look\n")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	inflated, err := zlib.NewReader(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBytes(t, inflated, []byte("look\n"))
+	// turning compression off ends the compressed stream, with the reply in it
+	if _, err := server.Write(common.TelnetNegotiate(common.TelnetWONT, common.TelnetOptionMCCP3)); err != nil {
+		t.Fatal(err)
+	}
+	expectBytes(t, inflated, common.TelnetNegotiate(common.TelnetDONT, common.TelnetOptionMCCP3))
+	if rest, err := io.ReadAll(inflated); err != nil || len(rest) != 0 {
+		t.Fatalf("Wanted the compressed stream to end, got %q, %v", rest, err)
+	}
+	if err := proxy.ProxyTransmit(common.Chunk{Data: []byte("north\n")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectBytes(t, in, []byte("north\n"))
+}
+
+func TestMCCP2NotNegotiated(t *testing.T) {
+	proxy := New()
+	server := connectServer(t, proxy)
+	b := common.TelnetSubnegotiate(common.TelnetOptionMCCP2, nil)
+	b = append(b, "still plain\n"...)
+	if _, err := server.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if text := receivedText(t, proxy, len("still plain\n")); text != "still plain\n" {
+		t.Fatalf("Got %q", text)
+	}
+}
+
+func TestMCCP2NestedStart(t *testing.T) {
+	proxy := New()
+	server := connectServer(t, proxy)
+	if _, err := server.Write(common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionMCCP2)); err != nil {
+		t.Fatal(err)
+	}
+	expectBytes(t, server, common.TelnetNegotiate(common.TelnetDO, common.TelnetOptionMCCP2))
+	// the stream is already compressed, so the start inside it must not swallow what follows
+	b := common.TelnetSubnegotiate(common.TelnetOptionMCCP2, nil)
+	b = append(b, deflate(t, "one\n"+string(common.TelnetSubnegotiate(common.TelnetOptionMCCP2, nil))+"two\n")...)
+	if _, err := server.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if text := receivedText(t, proxy, len("one\ntwo\n")); text != "one\ntwo\n" {
+		t.Fatalf("Got %q", text)
+	}
+}
@@ -0,0 +1,17 @@
+package proxy
+
+import (
+	"github.com/zond/moxie/metrics"
+)
+
+// Metrics makes the proxy record what it does in registry.
+func (self *Proxy) Metrics(registry *metrics.Registry) *Proxy {
+	self.metrics = registry
+	registry.Func("moxie_proxy_buffer_depth", "How many chunks wait in the buffer for delivery.", func() float64 {
+		return float64(len(self.buffer))
+	})
+	registry.Func("moxie_proxy_buffer_capacity", "How many chunks fit in the buffer.", func() float64 {
+		return float64(cap(self.buffer))
+	})
+	return self
+}
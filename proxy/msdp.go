@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/zond/moxie/common"
+)
+
+func (self *session) handleMSDP(data []byte) {
+	variables, err := common.ParseMSDP(data)
+	if err != nil {
+		self.log(err.Error())
+		return
+	}
+	self.lock.Lock()
+	for _, variable := range variables {
+		self.msdp[variable.Name] = variable.Value
+	}
+	self.lock.Unlock()
+	for _, variable := range variables {
+		variable.Session = self.name
+		self.proxy.notifySubscribers(common.SubscriberMSDP, variable)
+	}
+}
+
+func (self *session) handleMSSP(data []byte) {
+	status, err := common.ParseMSSP(data)
+	if err != nil {
+		self.log(err.Error())
+		return
+	}
+	self.lock.Lock()
+	self.mssp = status
+	self.lock.Unlock()
+	self.proxy.notifySubscribers(common.SubscriberMSSP, common.MSSPStatus{
+		Session: self.name,
+		Values:  status,
+	})
+}
+
+func (self *Proxy) ProxyMSDP(name string, result *map[string]common.MSDPValue) (err error) {
+	sess, err := self.session(name)
+	if err != nil {
+		return
+	}
+	sess.lock.RLock()
+	defer sess.lock.RUnlock()
+	*result = map[string]common.MSDPValue{}
+	for name, value := range sess.msdp {
+		(*result)[name] = value
+	}
+	return
+}
+
+func (self *Proxy) ProxyMSSP(name string, result *map[string][]string) (err error) {
+	sess, err := self.session(name)
+	if err != nil {
+		return
+	}
+	sess.lock.RLock()
+	defer sess.lock.RUnlock()
+	*result = map[string][]string{}
+	for name, values := range sess.mssp {
+		(*result)[name] = values
+	}
+	return
+}
+
+// ProxyTransmitMSDP sends each variable to the session it names.
+func (self *Proxy) ProxyTransmitMSDP(variables []common.MSDPVariable, unused *struct{}) (err error) {
+	for _, variable := range variables {
+		var sess *session
+		if sess, err = self.session(variable.Session); err != nil {
+			return
+		}
+		sess.lock.RLock()
+		enabled := sess.telnetState(common.TelnetOptionMSDP).Remote
+		sess.lock.RUnlock()
+		if !enabled {
+			err = fmt.Errorf("MSDP not enabled for %v", sess.name)
+			return
+		}
+		if err = sess.write(common.TelnetSubnegotiate(common.TelnetOptionMSDP, variable.Bytes())); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/zond/moxie/common"
+)
+
+var defaultWindowSize = common.WindowSize{
+	Width:  80,
+	Height: 24,
+}
+
+// windowSize prefers the size of the consumer, since that is where the output of the server is shown. Callers must
+// hold at least a read lock.
+func (self *Proxy) windowSize() common.WindowSize {
+	for _, source := range []string{common.WindowSizeConsumer, common.WindowSizeController} {
+		if size, found := self.windowSizes[source]; found {
+			return size
+		}
+	}
+	return defaultWindowSize
+}
+
+func clampWindowDimension(i int) int {
+	if i < 0 {
+		return 0
+	}
+	if i > 0xffff {
+		return 0xffff
+	}
+	return i
+}
+
+func (self *session) sendWindowSize() (err error) {
+	self.lock.RLock()
+	enabled := self.telnetState(common.TelnetOptionNAWS).Local
+	self.lock.RUnlock()
+	self.proxy.lock.RLock()
+	size := self.proxy.windowSize()
+	self.proxy.lock.RUnlock()
+	if !enabled {
+		return
+	}
+	width, height := clampWindowDimension(size.Width), clampWindowDimension(size.Height)
+	return self.write(common.TelnetSubnegotiate(common.TelnetOptionNAWS, []byte{byte(width >> 8), byte(width), byte(height >> 8), byte(height)}))
+}
+
+func (self *Proxy) ProxyWindowSize(size common.WindowSize, unused *struct{}) (err error) {
+	self.lock.Lock()
+	before := self.windowSize()
+	self.windowSizes[size.Source] = size
+	after := self.windowSize()
+	sessions := make([]*session, 0, len(self.sessions))
+	for _, sess := range self.sessions {
+		sessions = append(sessions, sess)
+	}
+	self.lock.Unlock()
+	if before.Width != after.Width || before.Height != after.Height {
+		self.Log(fmt.Sprintf("Window size %vx%v reported by %v", after.Width, after.Height, after.Source), nil)
+		for _, sess := range sessions {
+			if sendErr := sess.sendWindowSize(); sendErr != nil {
+				err = sendErr
+			}
+		}
+	}
+	return
+}
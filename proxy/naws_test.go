@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/zond/moxie/common"
+)
+
+func TestNAWS(t *testing.T) {
+	proxy := New()
+	server := connectServer(t, proxy)
+	if _, err := server.Write(common.TelnetNegotiate(common.TelnetDO, common.TelnetOptionNAWS)); err != nil {
+		t.Fatal(err)
+	}
+	expectBytes(t, server, common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionNAWS))
+	expectBytes(t, server, common.TelnetSubnegotiate(common.TelnetOptionNAWS, []byte{0, 80, 0, 24}))
+	for _, test := range []struct {
+		size     common.WindowSize
+		expected []byte
+	}{
+		{common.WindowSize{Source: common.WindowSizeController, Width: 100, Height: 300}, []byte{0, 100, 1, 44}},
+		// the consumer shows the output, so its size wins, and sizes are clamped and escaped
+		{common.WindowSize{Source: common.WindowSizeConsumer, Width: 255, Height: 70000}, []byte{0, 255, 255, 255}},
+		// hidden by the size of the consumer, so nothing is sent
+		{common.WindowSize{Source: common.WindowSizeController, Width: 90, Height: 30}, nil},
+		{common.WindowSize{Source: common.WindowSizeConsumer, Width: -1, Height: 40}, []byte{0, 0, 0, 40}},
+	} {
+		if err := proxy.ProxyWindowSize(test.size, nil); err != nil {
+			t.Fatal(err)
+		}
+		if test.expected != nil {
+			expectBytes(t, server, common.TelnetSubnegotiate(common.TelnetOptionNAWS, test.expected))
+		}
+	}
+}
@@ -3,156 +3,227 @@ package proxy
 import (
 	"fmt"
 	"log"
-	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/zond/mdnsrpc"
 	"github.com/zond/moxie/common"
+	"github.com/zond/moxie/metrics"
 )
 
 type Proxy struct {
-	conn   *net.TCPConn
-	buffer chan []byte
-	lock   *sync.RWMutex
+	sessions          map[string]*session
+	buffer            chan queued
+	consuming         bool
+	mccp3             bool
+	reconnectAttempts int
+	reconnectDelay    time.Duration
+	reconnectMaxDelay time.Duration
+	tls               bool
+	tlsInsecure       bool
+	tlsFingerprint    string
+	charset           string
+	windowSizes       map[string]common.WindowSize
+	scrollback        *scrollback
+	queues            map[string]*deliveryQueue
+	queueSize         int
+	overflow          string
+	queueLock         *sync.Mutex
+	seq               uint64
+	seqLock           *sync.Mutex
+	promptPattern     *regexp.Regexp
+	promptTimeout     time.Duration
+	commandRate       float64
+	promptWait        time.Duration
+	upstream          *url.URL
+	listenAddr        string
+	listenPassword    string
+	listenReplay      int
+	metrics           *metrics.Registry
+	lock              *sync.RWMutex
 }
 
 func New() (result *Proxy) {
 	result = &Proxy{
-		buffer: make(chan []byte, 2<<16),
-		lock:   &sync.RWMutex{},
+		sessions:      map[string]*session{},
+		buffer:        make(chan queued, 2<<16),
+		windowSizes:   map[string]common.WindowSize{},
+		scrollback:    newScrollback(),
+		queues:        map[string]*deliveryQueue{},
+		queueSize:     defaultQueueSize,
+		overflow:      common.OverflowDropOldest,
+		queueLock:     &sync.Mutex{},
+		seqLock:       &sync.Mutex{},
+		promptTimeout: defaultPromptTimeout,
+		lock:          &sync.RWMutex{},
 	}
 	return
 }
 
-func (self *Proxy) receiveFromRemote(conn *net.TCPConn) {
-	buf := make([]byte, 4096)
-	read, err := conn.Read(buf)
-	for ; err == nil; read, err = conn.Read(buf) {
-		cpy := make([]byte, read)
-		copy(cpy, buf)
-		self.buffer <- cpy
-	}
-	self.buffer <- []byte(fmt.Sprintf("Reading from %v: %v\n", conn, err))
+func (self *Proxy) MCCP3(b bool) *Proxy {
+	self.mccp3 = b
+	return self
 }
 
 func (self *Proxy) Log(s string, unused *struct{}) (err error) {
-	log.Printf(s)
-	loggers, err := mdnsrpc.LookupAll(common.Subscriber)
-	if err != nil {
-		return
-	}
-	for _, client := range loggers {
-		if err := client.Call(common.SubscriberLog, s, nil); err != nil {
-			log.Printf(err.Error())
-		}
-	}
+	log.Printf("%v", s)
+	self.deliver(common.Subscriber, common.SubscriberLog, s)
 	return
 }
 
-func (self *Proxy) sendToConsumers(b []byte) (consumers mdnsrpc.Clients, err error) {
-	for len(consumers) == 0 {
-		consumers, err = mdnsrpc.LookupAll(common.Consumer)
-		if err != nil {
-			if _, ok := err.(mdnsrpc.NoSuchService); !ok {
-				self.Log(err.Error(), nil)
+func (self *Proxy) notifySubscribers(method string, arg interface{}) {
+	self.deliver(common.Subscriber, method, arg)
+}
+
+// queued is a chunk, or a notification for subscribers that has to reach them in order with the chunks around it.
+type queued struct {
+	chunk  common.Chunk
+	method string
+	arg    interface{}
+}
+
+// notifyInOrder is notifySubscribers for notifications, like connection events, that have to be delivered after the
+// chunks queued before them.
+func (self *Proxy) notifyInOrder(method string, arg interface{}) {
+	self.buffer <- queued{method: method, arg: arg}
+}
+
+// enqueue numbers the chunk and queues it for delivery. Transmitted and received chunks share the buffer, so that they
+// are delivered in the order they were numbered.
+func (self *Proxy) enqueue(chunk common.Chunk) {
+	self.seqLock.Lock()
+	defer self.seqLock.Unlock()
+	self.seq++
+	chunk.Seq = self.seq
+	chunk.Time = time.Now()
+	self.buffer <- queued{chunk: chunk}
+}
+
+// consume never waits for consumers to appear, since consumers attaching later can replay the scrollback.
+func (self *Proxy) consume() {
+	framers := map[string]*framer{}
+	ticker := time.NewTicker(promptTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case item := <-self.buffer:
+			if item.method != "" {
+				self.notifySubscribers(item.method, item.arg)
+				continue
 			}
+			chunk := item.chunk
+			self.metrics.CountChunk(chunk)
+			if chunk.Transmitted {
+				self.deliver(common.Subscriber, common.SubscriberTransmit, chunk)
+				continue
+			}
+			if len(chunk.Data) > 0 {
+				if err := self.scrollback.add(chunk); err != nil {
+					self.Log(err.Error(), nil)
+				}
+				self.deliver(common.Consumer, common.ConsumerConsume, chunk)
+				self.deliver(common.Subscriber, common.SubscriberReceive, chunk)
+			}
+			self.frame(framers, chunk)
+		case <-ticker.C:
+			self.flushPrompts(framers)
 		}
-		time.Sleep(time.Second / 2)
 	}
-	for _, client := range consumers {
-		if err = client.Call(common.ConsumerConsume, b, nil); err != nil {
-			return
-		}
+}
+
+func (self *Proxy) sessionNames() (result []string) {
+	for name := range self.sessions {
+		result = append(result, name)
 	}
+	sort.Strings(result)
 	return
 }
 
-func (self *Proxy) consume() {
-	lastConsumers := mdnsrpc.Clients{}
-	lastSubscribers := mdnsrpc.Clients{}
-	for b := range self.buffer {
-		var err error
-		var consumers mdnsrpc.Clients
-		for consumers, err = self.sendToConsumers(b); err != nil; consumers, err = self.sendToConsumers(b) {
-			time.Sleep(time.Second / 2)
-		}
-		if !lastConsumers.Equals(consumers) {
-			log.Printf("New consumers found: %+v", consumers)
-			lastConsumers = consumers
-		}
-		subscribers, err := mdnsrpc.LookupAll(common.Subscriber)
-		if err != nil {
-			if _, ok := err.(mdnsrpc.NoSuchService); ok {
-				err = nil
-			} else {
-				self.Log(err.Error(), nil)
-			}
-		}
-		if !lastSubscribers.Equals(subscribers) {
-			log.Printf("New subscribers found: %+v", subscribers)
-			lastSubscribers = subscribers
+// session finds the named session. The empty name means the default session, or the only session if there is just one.
+func (self *Proxy) session(name string) (result *session, err error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if name == "" {
+		if result = self.sessions[common.DefaultSession]; result != nil {
+			return
 		}
-		for _, client := range subscribers {
-			if err := client.Call(common.SubscriberReceive, b, nil); err != nil {
-				self.Log(err.Error(), nil)
+		if len(self.sessions) == 1 {
+			for _, sess := range self.sessions {
+				result = sess
 			}
+			return
 		}
+		err = fmt.Errorf("No session named and no %#v session among %v", common.DefaultSession, strings.Join(self.sessionNames(), ", "))
+		return
+	}
+	if result = self.sessions[name]; result == nil {
+		err = fmt.Errorf("No session %#v among %v", name, strings.Join(self.sessionNames(), ", "))
+		return
 	}
+	return
 }
 
 func (self *Proxy) Connect(addr string, unused *struct{}) (err error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		return
-	}
+	return self.ConnectSession(common.DefaultSession, addr)
+}
 
+// ConnectSession connects the named session to addr, creating the session if necessary and replacing any previous
+// connection it had.
+func (self *Proxy) ConnectSession(name, addr string) (err error) {
 	self.lock.Lock()
-	defer self.lock.Unlock()
-
-	if self.conn != nil {
-		self.conn.Close()
+	sess, found := self.sessions[name]
+	if !found {
+		sess = newSession(self, name)
+		self.sessions[name] = sess
 	}
+	if !self.consuming {
+		self.consuming = true
+		go self.consume()
+	}
+	self.lock.Unlock()
+	if err = sess.connect(addr, 0, -1); err != nil && !found {
+		self.removeUnconnected(sess)
+	}
+	return
+}
 
-	if self.conn, err = net.DialTCP("tcp", nil, tcpAddr); err != nil {
+// removeUnconnected forgets a session created for a connection that failed, so that it doesn't show up in the status
+// or take commands without ever having had a connection.
+func (self *Proxy) removeUnconnected(sess *session) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if self.sessions[sess.name] != sess || sess.conn != nil || sess.replaying {
 		return
 	}
-
-	go self.consume()
-
-	go self.receiveFromRemote(self.conn)
-
-	return
+	delete(self.sessions, sess.name)
+	sess.removed = true
+	close(sess.commandSignal)
 }
 
-func (self *Proxy) ProxyTransmit(s string, unused *struct{}) (err error) {
-	toWrite := []byte(s)
-	wrote := 0
-	for len(toWrite) > 0 {
-		if wrote, err = self.conn.Write(toWrite); err != nil {
-			return
-		}
-		toWrite = toWrite[wrote:]
+// ProxyTransmit sends the chunk as a command. With pacing it is queued to be sent as fast as the pacing allows, and
+// only errors queueing it are returned.
+func (self *Proxy) ProxyTransmit(chunk common.Chunk, unused *struct{}) (err error) {
+	sess, err := self.session(chunk.Session)
+	if err != nil {
+		return
 	}
-	go func() {
-		subscribers, err := mdnsrpc.LookupAll(common.Subscriber)
-		if err != nil {
-			if _, ok := err.(mdnsrpc.NoSuchService); ok {
-				err = nil
-			} else {
-				self.Log(err.Error(), nil)
-			}
-		}
-		for _, client := range subscribers {
-			if err := client.Call(common.SubscriberTransmit, []byte(s), nil); err != nil {
-				self.Log(err.Error(), nil)
-			}
-		}
-	}()
-	return
+	if self.commandRate == 0 && self.promptWait == 0 {
+		// nothing to wait for, so the command is sent right away and the caller learns if writing it failed
+		return sess.transmit(chunk.Data, sess.masked())
+	}
+	return sess.queueCommand(chunk.Data)
 }
 
 func (self *Proxy) Publish(unused struct{}, unused2 *struct{}) (err error) {
+	if err = self.listen(); err != nil {
+		return
+	}
 	done, err := mdnsrpc.Publish(common.Proxy, self)
 	if err != nil {
 		return
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+// minReconnectDelay keeps a server refusing connections from being hammered in a tight loop.
+const minReconnectDelay = 100 * time.Millisecond
+
+// Reconnect makes the proxy reconnect when the connection drops, waiting delay before the first attempt and doubling
+// it for every failure up to maxDelay. attempts is the max number of attempts, 0 disables reconnecting and a negative
+// number never gives up. Delays shorter than minReconnectDelay are raised to it.
+func (self *Proxy) Reconnect(attempts int, delay, maxDelay time.Duration) *Proxy {
+	if delay < minReconnectDelay {
+		delay = minReconnectDelay
+	}
+	if maxDelay < delay {
+		maxDelay = delay
+	}
+	self.reconnectAttempts = attempts
+	self.reconnectDelay = delay
+	self.reconnectMaxDelay = maxDelay
+	return self
+}
+
+func (self *session) disconnected(conn net.Conn, addr string, cause error) {
+	self.lock.Lock()
+	current := self.conn == conn
+	wasMasked := false
+	if current {
+		self.conn = nil
+		wasMasked = self.clearOptions()
+	}
+	self.lock.Unlock()
+	conn.Close()
+	// replaced or deliberately closed connections are not reconnected
+	if !current {
+		return
+	}
+	if wasMasked {
+		self.unmask()
+	}
+	self.receive([]byte(fmt.Sprintf("Disconnected from %v: %v\n", addr, cause)), false)
+	self.proxy.notifyInOrder(common.SubscriberDisconnected, common.ConnectionEvent{
+		Session:      self.name,
+		Addr:         addr,
+		Time:         time.Now(),
+		Error:        cause.Error(),
+		Reconnecting: self.proxy.reconnectAttempts != 0,
+	})
+	if self.proxy.reconnectAttempts != 0 {
+		self.reconnect(addr)
+	}
+}
+
+func (self *session) reconnect(addr string) {
+	self.lock.RLock()
+	generation := self.generation
+	self.lock.RUnlock()
+	delay := self.proxy.reconnectDelay
+	for attempt := 1; self.proxy.reconnectAttempts < 0 || attempt <= self.proxy.reconnectAttempts; attempt++ {
+		self.log(fmt.Sprintf("Reconnecting to %v in %v, attempt %v", addr, delay, attempt))
+		time.Sleep(delay)
+		self.lock.RLock()
+		changed := self.generation != generation
+		self.lock.RUnlock()
+		if changed {
+			self.log(fmt.Sprintf("Connection changed while waiting, no longer reconnecting to %v", addr))
+			return
+		}
+		self.proxy.metrics.Add("moxie_proxy_reconnect_attempts_total", "How many times reconnecting was attempted.", 1, "session", self.name)
+		err := self.connect(addr, attempt, generation)
+		if err == nil {
+			self.proxy.metrics.Add("moxie_proxy_reconnects_total", "How many times reconnecting succeeded.", 1, "session", self.name)
+			return
+		}
+		self.log(fmt.Sprintf("Reconnecting to %v failed: %v", addr, err))
+		if delay *= 2; delay > self.proxy.reconnectMaxDelay {
+			delay = self.proxy.reconnectMaxDelay
+		}
+	}
+	self.receive([]byte(fmt.Sprintf("Giving up reconnecting to %v\n", addr)), false)
+	self.log(fmt.Sprintf("Giving up reconnecting to %v after %v attempts", addr, self.proxy.reconnectAttempts))
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	proxy := New().Reconnect(3, minReconnectDelay, 5*minReconnectDelay/2)
+	logs := subscribe(t, proxy, common.SubscriberLog)
+	proxy.consuming = true
+	if err := proxy.ConnectSession(common.DefaultSession, addr); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens any more, so every attempt fails
+	listener.Close()
+	conn.Close()
+	expected := []string{}
+	for attempt, delay := range []time.Duration{minReconnectDelay, 2 * minReconnectDelay, 5 * minReconnectDelay / 2} {
+		expected = append(expected, fmt.Sprintf("Reconnecting to %v in %v, attempt %v", addr, delay, attempt+1))
+	}
+	expected = append(expected, fmt.Sprintf("Giving up reconnecting to %v after 3 attempts", addr))
+	got := []string{}
+	for len(got) < len(expected) {
+		if msg := nextArg(t, logs).(string); strings.Contains(msg, ", attempt ") || strings.Contains(msg, "Giving up") {
+			got = append(got, strings.TrimPrefix(msg, common.DefaultSession+": "))
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Wanted %q, got %q", expected, got)
+	}
+}
+
+func TestReconnectEvents(t *testing.T) {
+	proxy := New().Reconnect(1, 0, 0)
+	server := connectServer(t, proxy)
+	t.Cleanup(func() {
+		proxy.ProxyDisconnect("", nil)
+	})
+	if item := nextItem(t, proxy); item.method != common.SubscriberConnected {
+		t.Fatalf("Wanted the session connected, got %+v", item)
+	}
+	server.Close()
+	if chunk := nextChunk(t, proxy); !strings.HasPrefix(string(chunk.Data), "Disconnected from") {
+		t.Fatalf("Wanted the reason for disconnecting, got %q", chunk.Data)
+	}
+	for _, expected := range []string{common.SubscriberDisconnected, common.SubscriberConnected} {
+		item := nextItem(t, proxy)
+		if item.method != expected {
+			t.Fatalf("Wanted %v, got %+v", expected, item)
+		}
+		event := item.arg.(common.ConnectionEvent)
+		if expected == common.SubscriberDisconnected && !event.Reconnecting {
+			t.Fatalf("Wanted the disconnection to promise a reconnect, got %+v", event)
+		}
+		if expected == common.SubscriberConnected && event.Attempt != 1 {
+			t.Fatalf("Wanted the first attempt to reconnect, got %+v", event)
+		}
+	}
+}
+
+func TestDisconnectUnmasks(t *testing.T) {
+	proxy := New()
+	echoes := subscribe(t, proxy, common.SubscriberEcho)
+	for _, disconnect := range []func(server net.Conn){
+		func(server net.Conn) {
+			server.Close()
+		},
+		func(server net.Conn) {
+			if err := proxy.ProxyDisconnect("", nil); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		server := connectServer(t, proxy)
+		// servers turn echo on to make the client hide passwords
+		if _, err := server.Write(common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionEcho)); err != nil {
+			t.Fatal(err)
+		}
+		expectBytes(t, server, common.TelnetNegotiate(common.TelnetDO, common.TelnetOptionEcho))
+		if state := nextArg(t, echoes).(common.EchoState); !state.Masked {
+			t.Fatalf("Wanted input masked, got %+v", state)
+		}
+		disconnect(server)
+		if state := nextArg(t, echoes).(common.EchoState); state.Masked {
+			t.Fatalf("Wanted input unmasked when disconnected, got %+v", state)
+		}
+		options := []common.TelnetOption{}
+		if err := proxy.ProxyTelnetOptions("", &options); err != nil {
+			t.Fatal(err)
+		}
+		if len(options) != 0 {
+			t.Fatalf("Wanted the options forgotten, got %+v", options)
+		}
+	}
+}
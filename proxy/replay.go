@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/zond/moxie/common"
+	"github.com/zond/moxie/recorder"
+)
+
+// ReplaySession plays back the recording at path as the named session, at speed times the original pace, or as fast as
+// possible if speed is 0. The session has no connection, so commands sent to it are logged instead of sent anywhere.
+// Recorded commands are echoed like a server would, and output they follow without a newline is a prompt.
+func (self *Proxy) ReplaySession(name, path string, speed float64) (err error) {
+	events, err := recorder.ReadFile(path)
+	if err != nil {
+		return
+	}
+	self.lock.Lock()
+	sess, found := self.sessions[name]
+	if !found {
+		sess = newSession(self, name)
+		self.sessions[name] = sess
+	}
+	sess.lock.Lock()
+	sess.replaying = true
+	sess.addr = "replay://" + path
+	sess.lock.Unlock()
+	if !self.consuming {
+		self.consuming = true
+		go self.consume()
+	}
+	self.lock.Unlock()
+	go sess.replay(events, speed)
+	return
+}
+
+func (self *session) replay(events []recorder.Event, speed float64) {
+	self.lock.RLock()
+	addr := self.addr
+	self.lock.RUnlock()
+	self.proxy.notifyInOrder(common.SubscriberConnected, common.ConnectionEvent{
+		Session: self.name,
+		Addr:    addr,
+		Time:    time.Now(),
+	})
+	started := time.Now()
+	for index, event := range events {
+		if speed > 0 {
+			if wait := started.Add(time.Duration(float64(event.Offset) / speed)).Sub(time.Now()); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if event.Transmitted {
+			self.log(fmt.Sprintf("Recorded command %#v", string(event.Data)))
+			self.proxy.enqueue(common.Chunk{
+				Session:     self.name,
+				Data:        event.Data,
+				Transmitted: true,
+			})
+			echo := append([]byte{}, bytes.TrimRight(event.Data, "\r\n")...)
+			self.receive(append(echo, '\r', '\n'), false)
+		} else {
+			// recordings don't keep GA or EOR, but a command answering an unfinished line shows it was a prompt
+			prompt := index+1 < len(events) && events[index+1].Transmitted && !bytes.HasSuffix(event.Data, []byte("\n"))
+			self.receive(event.Data, prompt)
+		}
+	}
+	self.log(fmt.Sprintf("Replay of %v finished", addr))
+	self.proxy.notifyInOrder(common.SubscriberDisconnected, common.ConnectionEvent{
+		Session: self.name,
+		Addr:    addr,
+		Time:    time.Now(),
+		Error:   "Replay finished",
+	})
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+const testRecording = `{"version":2,"width":80,"height":24}
+[0.1,"o","Hello\r\n> "]
+[0.2,"i","look\n"]
+[0.3,"o","A room\r\n"]
+`
+
+// replay makes proxy replay testRecording at speed, without consuming its buffer.
+func replay(t *testing.T, proxy *Proxy, speed float64) {
+	path := filepath.Join(t.TempDir(), "test.cast")
+	if err := os.WriteFile(path, []byte(testRecording), 0600); err != nil {
+		t.Fatal(err)
+	}
+	proxy.consuming = true
+	if err := proxy.ReplaySession(common.DefaultSession, path, speed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	proxy := New()
+	started := time.Now()
+	replay(t, proxy, 2)
+	if item := nextItem(t, proxy); item.method != common.SubscriberConnected {
+		t.Fatalf("Wanted the replay to connect first, got %+v", item)
+	}
+	for _, expected := range []common.Chunk{
+		{Data: []byte("Hello\r\n> "), Prompt: true},
+		{Data: []byte("look\n"), Transmitted: true},
+		// the recorded command is echoed to consumers
+		{Data: []byte("look\r\n")},
+		{Data: []byte("A room\r\n")},
+	} {
+		item := nextItem(t, proxy)
+		if item.method != "" || item.chunk.Session != common.DefaultSession || string(item.chunk.Data) != string(expected.Data) || item.chunk.Transmitted != expected.Transmitted || item.chunk.Prompt != expected.Prompt {
+			t.Fatalf("Wanted %+v, got %+v", expected, item)
+		}
+	}
+	// twice the original pace plays the last event at 150ms
+	if elapsed := time.Now().Sub(started); elapsed < 140*time.Millisecond {
+		t.Fatalf("Wanted the replay paced, got it all in %v", elapsed)
+	}
+	if item := nextItem(t, proxy); item.method != common.SubscriberDisconnected {
+		t.Fatalf("Wanted the replay to disconnect when finished, got %+v", item)
+	}
+	// commands to the replay are shown, but sent nowhere
+	if err := proxy.ProxyTransmit(common.Chunk{Data: []byte("kill orc\n")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if chunk := nextChunk(t, proxy); string(chunk.Data) != "kill orc\n" || !chunk.Transmitted {
+		t.Fatalf("Wanted the command shown, got %+v", chunk)
+	}
+}
+
+func TestReplayUnpaced(t *testing.T) {
+	proxy := New()
+	started := time.Now()
+	replay(t, proxy, 0)
+	if text := receivedText(t, proxy, len("Hello\r\n> look\r\nA room\r\n")); text != "Hello\r\n> look\r\nA room\r\n" {
+		t.Fatalf("Got %q", text)
+	}
+	if elapsed := time.Now().Sub(started); elapsed >= 100*time.Millisecond {
+		t.Fatalf("Wanted the replay as fast as possible, took %v", elapsed)
+	}
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+const (
+	defaultScrollbackSize = 1 << 20
+	scrollbackFile        = "scrollback"
+	scrollbackOldFile     = "scrollback.old"
+	// every spilled record is the data, the session name, the sequence number, the time in nanoseconds, the length of
+	// the session name, the length of the data and a checksum of all that, so that the file can be read backwards from
+	// the end and what a write cut short left behind can be recognized
+	spillTrailerSize = 26
+	// received data arrives a few KiB at a time, so a valid record ending further back than this means the file is
+	// broken beyond a cut short write
+	maxSpillRecordSize = 1 << 16
+)
+
+// scrollback keeps the most recently received chunks in memory, and optionally spills the ones it evicts to a file, which
+// is rotated when it grows too large.
+type scrollback struct {
+	chunks    []common.Chunk
+	size      int
+	maxSize   int
+	dir       string
+	spillSize int64
+	spill     *os.File
+	spilled   int64
+	lock      *sync.Mutex
+}
+
+func newScrollback() *scrollback {
+	return &scrollback{
+		maxSize: defaultScrollbackSize,
+		lock:    &sync.Mutex{},
+	}
+}
+
+func (self *Proxy) Scrollback(size int) *Proxy {
+	self.scrollback.maxSize = size
+	return self
+}
+
+// ScrollbackSpill makes the proxy write chunks evicted from the scrollback to dir, keeping at most about two times size
+// bytes on disk. 0 disables spilling.
+func (self *Proxy) ScrollbackSpill(dir string, size int64) *Proxy {
+	self.scrollback.dir = dir
+	self.scrollback.spillSize = size
+	return self
+}
+
+func (self *scrollback) add(chunk common.Chunk) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.chunks = append(self.chunks, chunk)
+	self.size += len(chunk.Data)
+	for self.size > self.maxSize && len(self.chunks) > 0 {
+		evicted := self.chunks[0]
+		self.chunks = self.chunks[1:]
+		self.size -= len(evicted.Data)
+		if self.spillSize > 0 {
+			if spillErr := self.spillChunk(evicted); spillErr != nil {
+				err = spillErr
+			}
+		}
+	}
+	return
+}
+
+func (self *scrollback) openSpill() (err error) {
+	if err = os.MkdirAll(self.dir, 0700); err != nil {
+		return
+	}
+	if self.spill, err = os.OpenFile(filepath.Join(self.dir, scrollbackFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600); err != nil {
+		return
+	}
+	info, err := self.spill.Stat()
+	if err != nil {
+		return
+	}
+	// new records must follow a valid one to be found again
+	_, _, end, _, err := lastRecord(self.spill, info.Size())
+	if err != nil {
+		return
+	}
+	if end < info.Size() {
+		if err = self.spill.Truncate(end); err != nil {
+			return
+		}
+	}
+	self.spilled = end
+	return
+}
+
+func (self *scrollback) spillChunk(chunk common.Chunk) (err error) {
+	if self.spill == nil {
+		if err = self.openSpill(); err != nil {
+			return
+		}
+	}
+	record := make([]byte, 0, len(chunk.Data)+len(chunk.Session)+spillTrailerSize)
+	record = append(record, chunk.Data...)
+	record = append(record, chunk.Session...)
+	record = binary.BigEndian.AppendUint64(record, chunk.Seq)
+	record = binary.BigEndian.AppendUint64(record, uint64(chunk.Time.UnixNano()))
+	record = binary.BigEndian.AppendUint16(record, uint16(len(chunk.Session)))
+	record = binary.BigEndian.AppendUint32(record, uint32(len(chunk.Data)))
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(record))
+	if self.spilled > 0 && self.spilled+int64(len(record)) > self.spillSize {
+		if err = self.spill.Close(); err != nil {
+			return
+		}
+		self.spill = nil
+		if err = os.Rename(filepath.Join(self.dir, scrollbackFile), filepath.Join(self.dir, scrollbackOldFile)); err != nil {
+			return
+		}
+		if err = self.openSpill(); err != nil {
+			return
+		}
+	}
+	if err = writeAll(self.spill, record); err != nil {
+		return
+	}
+	self.spilled += int64(len(record))
+	return
+}
+
+// readRecord reads the record ending at pos, and returns where it starts. found is false if no valid record ends there.
+func readRecord(file *os.File, pos int64) (chunk common.Chunk, start int64, found bool, err error) {
+	if pos < spillTrailerSize {
+		return
+	}
+	trailer := make([]byte, spillTrailerSize)
+	if _, err = file.ReadAt(trailer, pos-spillTrailerSize); err != nil {
+		return
+	}
+	sessionLen := int64(binary.BigEndian.Uint16(trailer[16:]))
+	dataLen := int64(binary.BigEndian.Uint32(trailer[18:]))
+	if start = pos - spillTrailerSize - sessionLen - dataLen; start < 0 {
+		return
+	}
+	record := make([]byte, pos-start)
+	if _, err = file.ReadAt(record, start); err != nil {
+		return
+	}
+	checksummed := len(record) - 4
+	if crc32.ChecksumIEEE(record[:checksummed]) != binary.BigEndian.Uint32(record[checksummed:]) {
+		return
+	}
+	found = true
+	chunk = common.Chunk{
+		Session: string(record[dataLen : dataLen+sessionLen]),
+		Data:    record[:dataLen],
+		Seq:     binary.BigEndian.Uint64(trailer),
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(trailer[8:]))),
+	}
+	return
+}
+
+// lastRecord finds the last valid record ending at or before pos, skipping anything a write cut short left after it.
+// end is 0 if there is none.
+func lastRecord(file *os.File, pos int64) (chunk common.Chunk, start, end int64, found bool, err error) {
+	for end = pos; end > 0 && pos-end <= maxSpillRecordSize; end-- {
+		if chunk, start, found, err = readRecord(file, end); err != nil || found {
+			return
+		}
+	}
+	end = 0
+	return
+}
+
+// readSpillBackwards calls f with the records of the file at path, newest first, until f returns false. Broken records
+// end the file.
+func readSpillBackwards(path string, f func(common.Chunk) bool) (more bool, err error) {
+	more = true
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	chunk := common.Chunk{}
+	found := false
+	for pos := info.Size(); pos > 0 && more; {
+		if chunk, pos, _, found, err = lastRecord(file, pos); err != nil || !found {
+			return
+		}
+		more = f(chunk)
+	}
+	return
+}
+
+// tailer collects chunks from the end of the scrollback until it has the requested number of lines or bytes.
+type tailer struct {
+	request  common.ScrollbackRequest
+	newlines int
+	bytes    int
+	started  bool
+	result   []common.Chunk
+}
+
+func (self *tailer) add(chunk common.Chunk) (more bool) {
+	if self.request.Session != "" && chunk.Session != self.request.Session {
+		return true
+	}
+	data := chunk.Data
+	for index := len(data) - 1; index >= 0; index-- {
+		if self.request.Bytes > 0 && self.bytes == self.request.Bytes {
+			data = data[index+1:]
+			break
+		}
+		// a newline ending the scrollback does not start another line
+		if data[index] == '\n' && self.started {
+			if self.newlines++; self.request.Lines > 0 && self.newlines == self.request.Lines {
+				data = data[index+1:]
+				break
+			}
+		}
+		self.started = true
+		self.bytes++
+	}
+	if len(data) > 0 {
+		chunk.Data = data
+		self.result = append(self.result, chunk)
+	}
+	return !self.done()
+}
+
+func (self *tailer) done() bool {
+	return (self.request.Bytes > 0 && self.bytes >= self.request.Bytes) || (self.request.Lines > 0 && self.newlines >= self.request.Lines)
+}
+
+func (self *scrollback) tail(request common.ScrollbackRequest) (result []common.Chunk, err error) {
+	if request.Lines <= 0 && request.Bytes <= 0 {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	t := &tailer{
+		request: request,
+	}
+	more := true
+	for index := len(self.chunks) - 1; index >= 0 && more; index-- {
+		more = t.add(self.chunks[index])
+	}
+	if self.spillSize > 0 {
+		for _, name := range []string{scrollbackFile, scrollbackOldFile} {
+			if !more {
+				break
+			}
+			if more, err = readSpillBackwards(filepath.Join(self.dir, name), t.add); err != nil {
+				return
+			}
+		}
+	}
+	for index := len(t.result) - 1; index >= 0; index-- {
+		result = append(result, t.result[index])
+	}
+	return
+}
+
+func (self *Proxy) ProxyScrollback(request common.ScrollbackRequest, result *[]common.Chunk) (err error) {
+	*result, err = self.scrollback.tail(request)
+	return
+}
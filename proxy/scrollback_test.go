@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+// spilledScrollback returns a scrollback keeping nothing in memory, spilling count chunks to dir.
+func spilledScrollback(t *testing.T, dir string, count int) (result *scrollback, chunks []common.Chunk) {
+	result = newScrollback()
+	result.maxSize, result.dir, result.spillSize = 0, dir, 1<<20
+	for index := 0; index < count; index++ {
+		chunk := common.Chunk{
+			Session: fmt.Sprintf("session%v", index%2),
+			Data:    []byte(fmt.Sprintf("line %v\n", index)),
+			Seq:     uint64(index + 1),
+			Time:    time.Date(2020, 1, 2, 3, 4, 5, index, time.UTC),
+		}
+		if err := result.add(chunk); err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return
+}
+
+func assertChunks(t *testing.T, got, expected []common.Chunk) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("Wanted %v chunks, got %+v", len(expected), got)
+	}
+	for index := range got {
+		if got[index].Session != expected[index].Session || string(got[index].Data) != string(expected[index].Data) || got[index].Seq != expected[index].Seq || !got[index].Time.Equal(expected[index].Time) {
+			t.Fatalf("Wanted %+v at %v, got %+v", expected[index], index, got[index])
+		}
+	}
+}
+
+func TestScrollbackSpill(t *testing.T) {
+	sb, chunks := spilledScrollback(t, t.TempDir(), 5)
+	got, err := sb.tail(common.ScrollbackRequest{Lines: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertChunks(t, got, chunks)
+	got, err = sb.tail(common.ScrollbackRequest{Session: "session1", Lines: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertChunks(t, got, chunks[3:4])
+}
+
+func TestScrollbackSpillCorruptTail(t *testing.T) {
+	dir := t.TempDir()
+	sb, chunks := spilledScrollback(t, dir, 3)
+	sb.spill.Close()
+	path := filepath.Join(dir, scrollbackFile)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		tail []byte
+	}{
+		{"cut short", b[len(b)-10:]},
+		{"garbage", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"shorter than a trailer", []byte{1, 2, 3}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := os.WriteFile(path, append(append([]byte{}, b...), tc.tail...), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got := []common.Chunk{}
+			if _, err := readSpillBackwards(path, func(chunk common.Chunk) bool {
+				got = append([]common.Chunk{chunk}, got...)
+				return true
+			}); err != nil {
+				t.Fatal(err)
+			}
+			assertChunks(t, got, chunks)
+			// spilling more cuts the broken tail off, so that the new records can be found
+			reopened := newScrollback()
+			reopened.maxSize, reopened.dir, reopened.spillSize = 0, dir, 1<<20
+			more := common.Chunk{Session: "session0", Data: []byte("more\n"), Seq: 4, Time: time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC)}
+			if err := reopened.add(more); err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.spill.Close()
+			tail, err := reopened.tail(common.ScrollbackRequest{Lines: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertChunks(t, tail, append(append([]common.Chunk{}, chunks...), more))
+		})
+	}
+}
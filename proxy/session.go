@@ -0,0 +1,327 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zond/moxie/common"
+	"golang.org/x/text/encoding"
+)
+
+// session is one named connection to a server. A proxy can hold several at the same time.
+type session struct {
+	name           string
+	proxy          *Proxy
+	conn           net.Conn
+	addr           string
+	connectedSince time.Time
+	traffic        *traffic
+	generation     int
+	telnetOptions  map[byte]*common.TelnetOption
+	msdp           map[string]common.MSDPValue
+	mssp           map[string][]string
+	activeCharset  string
+	encoding       encoding.Encoding
+	deflater       *deflater
+	commands       []common.Chunk
+	commandSignal  chan struct{}
+	lastCommand    time.Time
+	prompted       chan struct{}
+	replaying      bool
+	removed        bool
+	lock           *sync.RWMutex
+	writeLock      *sync.Mutex
+	// orderLock keeps the response to a command from being queued before the command
+	orderLock *sync.Mutex
+}
+
+func newSession(proxy *Proxy, name string) (result *session) {
+	result = &session{
+		name:          name,
+		proxy:         proxy,
+		telnetOptions: map[byte]*common.TelnetOption{},
+		msdp:          map[string]common.MSDPValue{},
+		mssp:          map[string][]string{},
+		commandSignal: make(chan struct{}, 1),
+		prompted:      make(chan struct{}, 1),
+		lock:          &sync.RWMutex{},
+		writeLock:     &sync.Mutex{},
+		orderLock:     &sync.Mutex{},
+	}
+	go result.sendCommands()
+	return
+}
+
+func (self *session) log(s string) {
+	self.proxy.Log(fmt.Sprintf("%v: %v", self.name, s), nil)
+}
+
+func (self *session) receive(b []byte, prompt bool) {
+	self.orderLock.Lock()
+	defer self.orderLock.Unlock()
+	self.proxy.enqueue(common.Chunk{
+		Session: self.name,
+		Data:    b,
+		Prompt:  prompt,
+	})
+}
+
+func (self *session) receiveFromRemote(conn net.Conn, addr string) {
+	parser := &common.TelnetParser{}
+	counter := &countingReader{reader: conn}
+	in := bufio.NewReader(counter)
+	var inflater *inflater
+	var decoder *charsetDecoder
+	buf := make([]byte, 4096)
+	var err error
+	for err == nil {
+		var events []common.TelnetEvent
+		compressed := inflater != nil
+		if !compressed {
+			if _, err = in.Peek(1); err != nil {
+				break
+			}
+			var peeked []byte
+			if peeked, err = in.Peek(in.Buffered()); err != nil {
+				break
+			}
+			consumed := 0
+			events, consumed = parser.Parse(peeked)
+			if _, err = in.Discard(consumed); err != nil {
+				break
+			}
+		} else {
+			read, readErr := inflater.Read(buf)
+			for data := buf[:read]; len(data) > 0; {
+				parsed, consumed := parser.Parse(data)
+				events = append(events, parsed...)
+				if data = data[consumed:]; len(data) > 0 {
+					self.log("Ignoring start of MCCP2 compression inside the compressed stream")
+				}
+			}
+			if readErr == io.EOF {
+				self.log(inflater.String())
+				inflater.Close()
+				inflater = nil
+			} else {
+				err = readErr
+			}
+		}
+		texts, telnetErr := self.handleTelnet(events)
+		for _, r := range texts {
+			if r.text = self.decode(&decoder, r.text); len(r.text) > 0 || r.prompt {
+				self.receive(r.text, r.prompt)
+			}
+		}
+		if telnetErr != nil {
+			err = telnetErr
+			break
+		}
+		if len(events) > 0 && !compressed && err == nil {
+			if last := events[len(events)-1]; last.Type == common.TelnetSubnegotiation && last.Option == common.TelnetOptionMCCP2 {
+				self.lock.RLock()
+				negotiated := self.telnetState(common.TelnetOptionMCCP2).Remote
+				self.lock.RUnlock()
+				if !negotiated {
+					self.log("Ignoring start of MCCP2 compression, since it was not negotiated")
+				} else if inflater, err = newInflater(in, counter); err == nil {
+					self.log("MCCP2 compression started")
+				}
+			}
+		}
+	}
+	if inflater != nil {
+		self.log(inflater.String())
+	}
+	self.disconnected(conn, addr, err)
+}
+
+func writeAll(w io.Writer, b []byte) (err error) {
+	wrote := 0
+	for len(b) > 0 {
+		if wrote, err = w.Write(b); err != nil {
+			return
+		}
+		b = b[wrote:]
+	}
+	return
+}
+
+func (self *session) write(b []byte) (err error) {
+	self.lock.RLock()
+	conn, replaying := self.conn, self.replaying
+	self.lock.RUnlock()
+	if replaying {
+		return
+	}
+	if conn == nil {
+		err = fmt.Errorf("%v is not connected", self.name)
+		return
+	}
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if self.deflater != nil {
+		return writeAll(self.deflater, b)
+	}
+	return writeAll(conn, b)
+}
+
+// masked returns whether the server has turned local echo off.
+func (self *session) masked() bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.telnetState(common.TelnetOptionEcho).Remote
+}
+
+func (self *session) transmit(b []byte, secret bool) (err error) {
+	encoded, err := self.encode(string(b))
+	if err != nil {
+		return
+	}
+	self.lock.RLock()
+	conn, replaying := self.conn, self.replaying
+	self.lock.RUnlock()
+	if replaying {
+		self.log(fmt.Sprintf("Replaying, so not sending %#v", string(common.Chunk{Data: b, Secret: secret}.Redact().Data)))
+	} else if conn == nil {
+		err = fmt.Errorf("%v is not connected", self.name)
+		return
+	}
+	// queueing the command before writing it makes sure that any response is queued after it, without holding the order
+	// lock during a write that can wait for the server to read, which it might not do until it got rid of its own output
+	self.orderLock.Lock()
+	self.proxy.enqueue(common.Chunk{
+		Session:     self.name,
+		Data:        b,
+		Transmitted: true,
+		Secret:      secret,
+	}.Redact())
+	// only prompts arriving after this command mean the server is ready for the next
+	select {
+	case <-self.prompted:
+	default:
+	}
+	self.orderLock.Unlock()
+	if err = self.write(common.TelnetEscape(encoded)); err != nil {
+		return
+	}
+	self.lock.Lock()
+	self.lastCommand = time.Now()
+	self.lock.Unlock()
+	return
+}
+
+func (self *session) startDeflate() (err error) {
+	self.lock.RLock()
+	conn := self.conn
+	self.lock.RUnlock()
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if self.deflater != nil || conn == nil {
+		return
+	}
+	if err = writeAll(conn, common.TelnetSubnegotiate(common.TelnetOptionMCCP3, nil)); err != nil {
+		return
+	}
+	self.deflater = newDeflater(conn)
+	self.log("MCCP3 compression started")
+	return
+}
+
+func (self *session) stopDeflate() (err error) {
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if self.deflater == nil {
+		return
+	}
+	err = self.deflater.Close()
+	self.log(self.deflater.String())
+	self.deflater = nil
+	return
+}
+
+// connect connects the session to addr, replacing any current connection. Reconnect attempts pass the generation they
+// were started for, so that a connection made or closed by someone else while dialing is left alone, and other callers
+// pass a negative generation.
+func (self *session) connect(addr string, attempt int, generation int) (err error) {
+	useTLS, hostPort := self.proxy.splitTLS(addr)
+
+	enc, err := lookupCharset(self.proxy.charset)
+	if err != nil {
+		return
+	}
+	// dialing and handshaking can take long, so they are done before touching the session, which keeps its old
+	// connection if they fail
+	conn, err := self.proxy.dial(hostPort)
+	if err != nil {
+		return
+	}
+	counted := &countingConn{Conn: conn, traffic: &traffic{}}
+	conn = counted
+	if useTLS {
+		if conn, err = self.startTLS(conn, hostPort); err != nil {
+			return
+		}
+	}
+
+	self.lock.Lock()
+	if self.removed {
+		self.lock.Unlock()
+		conn.Close()
+		err = fmt.Errorf("Session %v was removed while dialing", self.name)
+		return
+	}
+	if generation >= 0 && generation != self.generation {
+		self.lock.Unlock()
+		conn.Close()
+		err = fmt.Errorf("Connection to %v changed while dialing", self.name)
+		return
+	}
+	replaced := ""
+	if self.conn != nil {
+		replaced = self.addr
+		self.conn.Close()
+	}
+	wasMasked := self.clearOptions()
+	self.msdp = map[string]common.MSDPValue{}
+	self.mssp = map[string][]string{}
+	self.writeLock.Lock()
+	if self.deflater != nil {
+		self.log(self.deflater.String())
+		self.deflater = nil
+	}
+	self.writeLock.Unlock()
+	self.conn = conn
+	self.addr = addr
+	self.connectedSince = time.Now()
+	self.traffic = counted.traffic
+	self.generation++
+	self.activeCharset, self.encoding = self.proxy.charset, enc
+	self.lock.Unlock()
+
+	if wasMasked {
+		self.unmask()
+	}
+	if replaced != "" {
+		self.proxy.notifyInOrder(common.SubscriberDisconnected, common.ConnectionEvent{
+			Session: self.name,
+			Addr:    replaced,
+			Time:    time.Now(),
+			Error:   fmt.Sprintf("Replaced by connection to %v", addr),
+		})
+	}
+	self.proxy.notifyInOrder(common.SubscriberConnected, common.ConnectionEvent{
+		Session: self.name,
+		Addr:    addr,
+		Time:    time.Now(),
+		Attempt: attempt,
+	})
+
+	go self.receiveFromRemote(conn, addr)
+
+	return
+}
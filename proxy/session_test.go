@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+// connectNamed connects the named session of proxy to a new server, and returns the server end of the connection.
+func connectNamed(t *testing.T, proxy *Proxy, name string) net.Conn {
+	accepted := make(chan net.Conn, 1)
+	addr := listenLocal(t, func(conn net.Conn) {
+		accepted <- conn
+	})
+	if err := proxy.ConnectSession(name, addr); err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestSessionsSideBySide(t *testing.T) {
+	proxy := New()
+	servers := map[string]net.Conn{
+		"a": connectNamed(t, proxy, "a"),
+		"b": connectNamed(t, proxy, "b"),
+	}
+	for name, server := range servers {
+		if _, err := server.Write([]byte("Welcome to " + name + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, server := range servers {
+		if err := proxy.ProxyTransmit(common.Chunk{Session: name, Data: []byte("look " + name + "\n")}, nil); err != nil {
+			t.Fatal(err)
+		}
+		expectBytes(t, server, []byte("look "+name+"\n"))
+		if _, err := server.Write([]byte("You are in " + name + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name := range servers {
+		expected := "Welcome to " + name + "\r\nYou are in " + name + "\r\n"
+		waitFor(t, "the scrollback of "+name, func() bool {
+			chunks := []common.Chunk{}
+			if err := proxy.ProxyScrollback(common.ScrollbackRequest{Session: name, Lines: 10}, &chunks); err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			for _, chunk := range chunks {
+				if chunk.Session != name {
+					t.Fatalf("Wanted only %v in its scrollback, got %+v", name, chunk)
+				}
+				got += string(chunk.Data)
+			}
+			return got == expected
+		})
+	}
+	// nothing sent to one session reaches the server of the other
+	expectNothing(t, servers["a"], time.Second/10)
+	expectNothing(t, servers["b"], time.Second/10)
+}
+
+func TestSessionFailedConnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	proxy := New()
+	if err := proxy.ConnectSession("gone", addr); err == nil {
+		t.Fatal("Wanted an error connecting to a closed port")
+	}
+	status := common.Status{}
+	if err := proxy.ProxyStatus(struct{}{}, &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Sessions) != 0 {
+		t.Fatalf("Wanted no session left by the failed connect, got %+v", status.Sessions)
+	}
+	if err := proxy.ProxyTransmit(common.Chunk{Session: "gone", Data: []byte("look\n")}, nil); err == nil {
+		t.Fatal("Wanted an error sending to a session that never connected")
+	}
+}
+
+func TestTransmitErrors(t *testing.T) {
+	for _, proxy := range []*Proxy{New(), New().Pacing(10, 0)} {
+		connectServer(t, proxy)
+		if err := proxy.ProxyTransmit(common.Chunk{Session: "missing", Data: []byte("look\n")}, nil); err == nil {
+			t.Fatal("Wanted an error sending to a missing session")
+		}
+		if err := proxy.ProxyDisconnect("", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := proxy.ProxyTransmit(common.Chunk{Data: []byte("look\n")}, nil); err == nil {
+			t.Fatal("Wanted an error sending to a disconnected session")
+		}
+	}
+}
+
+func TestTransmitOrder(t *testing.T) {
+	proxy := New()
+	proxy.consuming = true
+	if err := proxy.ConnectSession(common.DefaultSession, echoServer(t)); err != nil {
+		t.Fatal(err)
+	}
+	commands := 20
+	go func() {
+		for index := 0; index < commands; index++ {
+			proxy.ProxyTransmit(common.Chunk{Data: []byte(fmt.Sprintf("command %v\n", index))}, nil)
+		}
+	}()
+	seq := uint64(0)
+	transmitted := 0
+	echoed := ""
+	for {
+		chunk := nextChunk(t, proxy)
+		if chunk.Seq <= seq {
+			t.Fatalf("Wanted a sequence number after %v, got %+v", seq, chunk)
+		}
+		seq = chunk.Seq
+		if chunk.Transmitted {
+			if expected := fmt.Sprintf("command %v\n", transmitted); string(chunk.Data) != expected {
+				t.Fatalf("Wanted %q transmitted, got %q", expected, chunk.Data)
+			}
+			transmitted++
+			continue
+		}
+		echoed += string(chunk.Data)
+		// an echo must never arrive before the command it echoes
+		for index := strings.Index(echoed, "\n"); index != -1; index = strings.Index(echoed, "\n") {
+			var echoedCommand int
+			if _, err := fmt.Sscanf(echoed[:index], "command %d", &echoedCommand); err != nil {
+				t.Fatal(err)
+			}
+			if echoedCommand >= transmitted {
+				t.Fatalf("Got the echo of command %v before it was queued as transmitted", echoedCommand)
+			}
+			if echoed = echoed[index+1:]; echoedCommand == commands-1 {
+				return
+			}
+		}
+	}
+}
+
+func TestTransmitWhileServerWrites(t *testing.T) {
+	proxy := New()
+	server := connectServer(t, proxy)
+	go func() {
+		for range proxy.buffer {
+		}
+	}()
+	size := 1 << 23
+	output := bytes.Repeat([]byte("x"), size)
+	command := bytes.Repeat([]byte("y"), size)
+	// the server gets rid of all its output before reading any commands, like a server with a single thread might
+	serverDone := make(chan error, 1)
+	go func() {
+		if _, err := server.Write(output); err != nil {
+			serverDone <- err
+			return
+		}
+		_, err := io.ReadFull(server, make([]byte, size))
+		serverDone <- err
+	}()
+	transmitted := make(chan error, 1)
+	go func() {
+		transmitted <- proxy.ProxyTransmit(common.Chunk{Data: command}, nil)
+	}()
+	for _, done := range []chan error{transmitted, serverDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out, sending a command stopped the proxy from reading the server")
+		}
+	}
+}
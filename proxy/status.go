@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+// traffic counts the bytes of one connection, from the reading and writing goroutines at the same time.
+type traffic struct {
+	in  int64
+	out int64
+}
+
+type countingConn struct {
+	net.Conn
+	traffic *traffic
+}
+
+func (self *countingConn) Read(b []byte) (n int, err error) {
+	n, err = self.Conn.Read(b)
+	atomic.AddInt64(&self.traffic.in, int64(n))
+	return
+}
+
+func (self *countingConn) Write(b []byte) (n int, err error) {
+	n, err = self.Conn.Write(b)
+	atomic.AddInt64(&self.traffic.out, int64(n))
+	return
+}
+
+func (self *session) status() (result common.SessionStatus) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	result = common.SessionStatus{
+		Session:        self.name,
+		Addr:           self.addr,
+		Connected:      self.conn != nil,
+		Replaying:      self.replaying,
+		ConnectedSince: self.connectedSince,
+		QueuedCommands: len(self.commands),
+	}
+	if self.traffic != nil {
+		result.BytesIn = atomic.LoadInt64(&self.traffic.in)
+		result.BytesOut = atomic.LoadInt64(&self.traffic.out)
+	}
+	for code := 0; code < 256; code++ {
+		if option, found := self.telnetOptions[byte(code)]; found {
+			result.TelnetOptions = append(result.TelnetOptions, *option)
+		}
+	}
+	if conn, ok := self.conn.(*tls.Conn); ok {
+		state := tlsState(conn.ConnectionState(), self.proxy.tlsVerified())
+		result.TLS = &state
+	}
+	return
+}
+
+func (self *Proxy) ProxyStatus(unused struct{}, result *common.Status) (err error) {
+	self.lock.RLock()
+	sessions := make([]*session, 0, len(self.sessions))
+	for _, name := range self.sessionNames() {
+		sessions = append(sessions, self.sessions[name])
+	}
+	self.lock.RUnlock()
+	*result = common.Status{}
+	for _, sess := range sessions {
+		result.Sessions = append(result.Sessions, sess.status())
+	}
+	return self.ProxyDeliveryStats(struct{}{}, &result.Clients)
+}
+
+// ProxyConnect connects the named session, or the default one if the name is empty. Without an address, it reconnects
+// the session to where it was connected last.
+func (self *Proxy) ProxyConnect(request common.ConnectRequest, unused *struct{}) (err error) {
+	name, addr := request.Session, request.Addr
+	if sess, sessionErr := self.session(name); sessionErr == nil {
+		name = sess.name
+		if addr == "" {
+			sess.lock.RLock()
+			addr = sess.addr
+			sess.lock.RUnlock()
+		}
+	} else if name == "" {
+		name = common.DefaultSession
+	}
+	if addr == "" {
+		err = fmt.Errorf("No address to connect %v to", name)
+		return
+	}
+	return self.ConnectSession(name, addr)
+}
+
+// ProxyDisconnect closes the connection of the named session, without reconnecting it.
+func (self *Proxy) ProxyDisconnect(name string, unused *struct{}) (err error) {
+	sess, err := self.session(name)
+	if err != nil {
+		return
+	}
+	sess.lock.Lock()
+	conn, addr := sess.conn, sess.addr
+	sess.conn = nil
+	wasMasked := sess.clearOptions()
+	// stops any reconnect attempts in progress
+	sess.generation++
+	sess.lock.Unlock()
+	if conn == nil {
+		err = fmt.Errorf("%v is not connected", sess.name)
+		return
+	}
+	conn.Close()
+	if wasMasked {
+		sess.unmask()
+	}
+	sess.receive([]byte(fmt.Sprintf("Disconnected from %v on request\n", addr)), false)
+	sess.proxy.notifyInOrder(common.SubscriberDisconnected, common.ConnectionEvent{
+		Session: sess.name,
+		Addr:    addr,
+		Time:    time.Now(),
+		Error:   "Disconnected on request",
+	})
+	return
+}
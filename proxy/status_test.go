@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+func sessionStatus(t *testing.T, proxy *Proxy) common.SessionStatus {
+	t.Helper()
+	status := common.Status{}
+	if err := proxy.ProxyStatus(struct{}{}, &status); err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Sessions) != 1 {
+		t.Fatalf("Wanted one session, got %+v", status.Sessions)
+	}
+	return status.Sessions[0]
+}
+
+func TestStatusConnectDisconnect(t *testing.T) {
+	accepted := make(chan net.Conn, 2)
+	addr := listenLocal(t, func(conn net.Conn) {
+		accepted <- conn
+	})
+	proxy := New().Reconnect(-1, 0, 0)
+	proxy.consuming = true
+	if err := proxy.ProxyConnect(common.ConnectRequest{Addr: addr}, nil); err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	defer server.Close()
+	if err := server.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if item := nextItem(t, proxy); item.method != common.SubscriberConnected {
+		t.Fatalf("Wanted the session connected, got %+v", item)
+	}
+	if _, err := server.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	nextChunk(t, proxy)
+	transmit(t, proxy, "look\n")
+	expectBytes(t, server, []byte("look\n"))
+	nextChunk(t, proxy)
+	status := sessionStatus(t, proxy)
+	if status.Session != common.DefaultSession || status.Addr != addr || !status.Connected || status.ConnectedSince.IsZero() || status.BytesIn != 6 || status.BytesOut != 5 || status.TLS != nil {
+		t.Fatalf("Wanted the connection and its traffic, got %+v", status)
+	}
+	if err := proxy.ProxyDisconnect("", nil); err != nil {
+		t.Fatal(err)
+	}
+	// the reason is shown before subscribers are told of the disconnection
+	for _, item := range []queued{nextItem(t, proxy), nextItem(t, proxy)} {
+		if item.method == "" {
+			if string(item.chunk.Data) != "Disconnected from "+addr+" on request\n" {
+				t.Fatalf("Wanted the reason for disconnecting, got %q", item.chunk.Data)
+			}
+		} else if item.method != common.SubscriberDisconnected {
+			t.Fatalf("Wanted the session disconnected, got %+v", item)
+		}
+	}
+	// disconnecting on request doesn't reconnect
+	select {
+	case <-accepted:
+		t.Fatal("Wanted no reconnection")
+	case <-time.After(3 * minReconnectDelay):
+	}
+	if status := sessionStatus(t, proxy); status.Connected {
+		t.Fatalf("Wanted the session disconnected, got %+v", status)
+	}
+	if err := proxy.ProxyDisconnect(common.DefaultSession, nil); err == nil {
+		t.Fatal("Wanted an error disconnecting a disconnected session")
+	}
+	// without an address, the session connects to where it was before
+	if err := proxy.ProxyConnect(common.ConnectRequest{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	(<-accepted).Close()
+	if status := sessionStatus(t, proxy); !status.Connected || status.BytesIn != 0 || status.BytesOut != 0 {
+		t.Fatalf("Wanted a new connection, got %+v", status)
+	}
+}
+
+func TestConnectWithoutAddress(t *testing.T) {
+	if err := New().ProxyConnect(common.ConnectRequest{}, nil); err == nil {
+		t.Fatal("Wanted an error connecting without an address")
+	}
+}
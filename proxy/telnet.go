@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"fmt"
+
+	"github.com/zond/moxie/common"
+)
+
+const (
+	terminalTypeIs   = 0
+	terminalTypeSend = 1
+	terminalType     = "MOXIE"
+)
+
+var gmcpSupports = []string{
+	"Char 1",
+	"Char.Skills 1",
+	"Char.Items 1",
+	"Room 1",
+	"Comm 1",
+	"Group 1",
+}
+
+// options we want the server to perform
+var remoteOptions = map[byte]bool{
+	common.TelnetOptionEcho:            true,
+	common.TelnetOptionSuppressGoAhead: true,
+	common.TelnetOptionEndOfRecord:     true,
+	common.TelnetOptionMCCP2:           true,
+	common.TelnetOptionGMCP:            true,
+	common.TelnetOptionMSDP:            true,
+	common.TelnetOptionMSSP:            true,
+	common.TelnetOptionCharset:         true,
+}
+
+// options we are willing to perform
+var localOptions = map[byte]bool{
+	common.TelnetOptionTerminalType: true,
+	common.TelnetOptionCharset:      true,
+	common.TelnetOptionNAWS:         true,
+}
+
+func (self *session) telnetOption(option byte) (result *common.TelnetOption) {
+	result, found := self.telnetOptions[option]
+	if !found {
+		result = &common.TelnetOption{
+			Code: option,
+			Name: common.TelnetOptionName(option),
+		}
+		self.telnetOptions[option] = result
+	}
+	return
+}
+
+// telnetState returns the state of option without creating it, so a read lock is enough.
+func (self *session) telnetState(option byte) (result common.TelnetOption) {
+	if opt, found := self.telnetOptions[option]; found {
+		result = *opt
+	}
+	return
+}
+
+// clearOptions forgets what was negotiated with the server, and returns whether the server had turned echo off.
+// Callers must hold the lock, and call unmask afterwards if it had.
+func (self *session) clearOptions() (wasMasked bool) {
+	wasMasked = self.telnetState(common.TelnetOptionEcho).Remote
+	self.telnetOptions = map[byte]*common.TelnetOption{}
+	return
+}
+
+// unmask tells subscribers that input no longer has to be masked, since the server that asked for it is gone.
+func (self *session) unmask() {
+	self.proxy.notifySubscribers(common.SubscriberEcho, common.EchoState{
+		Session: self.name,
+	})
+}
+
+func (self *session) wantsRemote(option byte) bool {
+	if option == common.TelnetOptionMCCP3 {
+		return self.proxy.mccp3
+	}
+	return remoteOptions[option]
+}
+
+func (self *session) optionChanged(option common.TelnetOption) (err error) {
+	switch option.Code {
+	case common.TelnetOptionMCCP3:
+		if option.Remote {
+			return self.startDeflate()
+		}
+		return self.stopDeflate()
+	case common.TelnetOptionNAWS:
+		if option.Local {
+			return self.sendWindowSize()
+		}
+	case common.TelnetOptionEcho:
+		// a server that will echo is one that wants the client to stop echoing, like when asking for a password
+		self.proxy.notifySubscribers(common.SubscriberEcho, common.EchoState{
+			Session: self.name,
+			Masked:  option.Remote,
+		})
+	case common.TelnetOptionGMCP:
+		if option.Remote {
+			if err = self.writeGMCP(common.GMCPMessage{
+				Package: "Core.Hello",
+				Data: map[string]interface{}{
+					"client":  "moxie",
+					"version": "1",
+				},
+			}); err != nil {
+				return
+			}
+			if err = self.writeGMCP(common.GMCPMessage{
+				Package: "Core.Supports.Set",
+				Data:    gmcpSupports,
+			}); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (self *session) writeGMCP(msg common.GMCPMessage) (err error) {
+	b, err := msg.Bytes()
+	if err != nil {
+		return
+	}
+	return self.write(common.TelnetSubnegotiate(common.TelnetOptionGMCP, b))
+}
+
+func (self *Proxy) ProxyTransmitGMCP(msg common.GMCPMessage, unused *struct{}) (err error) {
+	sess, err := self.session(msg.Session)
+	if err != nil {
+		return
+	}
+	sess.lock.RLock()
+	enabled := sess.telnetState(common.TelnetOptionGMCP).Remote
+	sess.lock.RUnlock()
+	if !enabled {
+		err = fmt.Errorf("GMCP not enabled for %v", sess.name)
+		return
+	}
+	return sess.writeGMCP(msg)
+}
+
+func (self *session) negotiate(verb, option byte) (err error) {
+	var reply byte
+	changed := false
+	self.lock.Lock()
+	opt := self.telnetOption(option)
+	switch verb {
+	case common.TelnetWILL:
+		if self.wantsRemote(option) {
+			if !opt.Remote {
+				opt.Remote, changed, reply = true, true, common.TelnetDO
+			}
+		} else {
+			reply = common.TelnetDONT
+		}
+	case common.TelnetWONT:
+		if opt.Remote {
+			opt.Remote, changed, reply = false, true, common.TelnetDONT
+		}
+	case common.TelnetDO:
+		if localOptions[option] {
+			if !opt.Local {
+				opt.Local, changed, reply = true, true, common.TelnetWILL
+			}
+		} else {
+			reply = common.TelnetWONT
+		}
+	case common.TelnetDONT:
+		if opt.Local {
+			opt.Local, changed, reply = false, true, common.TelnetWONT
+		}
+	}
+	state := *opt
+	self.lock.Unlock()
+	if changed {
+		self.log(fmt.Sprintf("Telnet %v %v, now %v", common.TelnetVerbName(verb), state.Name, state))
+	}
+	if reply != 0 {
+		if err = self.write(common.TelnetNegotiate(reply, option)); err != nil {
+			return
+		}
+	}
+	if changed {
+		if err = self.optionChanged(state); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (self *session) subnegotiate(option byte, data []byte) (err error) {
+	switch option {
+	case common.TelnetOptionTerminalType:
+		if len(data) > 0 && data[0] == terminalTypeSend {
+			if err = self.write(common.TelnetSubnegotiate(option, append([]byte{terminalTypeIs}, []byte(terminalType)...))); err != nil {
+				return
+			}
+		}
+	case common.TelnetOptionGMCP:
+		if msg, parseErr := common.ParseGMCP(data); parseErr != nil {
+			self.log(parseErr.Error())
+		} else {
+			msg.Session = self.name
+			self.proxy.notifySubscribers(common.SubscriberGMCP, msg)
+		}
+	case common.TelnetOptionMSDP:
+		self.handleMSDP(data)
+	case common.TelnetOptionMSSP:
+		self.handleMSSP(data)
+	case common.TelnetOptionCharset:
+		if err = self.handleCharset(data); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// received is text from the server, and whether the server ended it with GA or EOR.
+type received struct {
+	text   []byte
+	prompt bool
+}
+
+func (self *session) handleTelnet(events []common.TelnetEvent) (result []received, err error) {
+	current := received{}
+	defer func() {
+		if len(current.text) > 0 {
+			result = append(result, current)
+		}
+	}()
+	for _, event := range events {
+		switch event.Type {
+		case common.TelnetText:
+			current.text = append(current.text, event.Data...)
+		case common.TelnetCommand:
+			if event.Verb == common.TelnetGA || event.Verb == common.TelnetEOR {
+				current.prompt = true
+				result = append(result, current)
+				current = received{}
+			}
+		case common.TelnetNegotiation:
+			if err = self.negotiate(event.Verb, event.Option); err != nil {
+				return
+			}
+		case common.TelnetSubnegotiation:
+			if err = self.subnegotiate(event.Option, event.Data); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (self *Proxy) ProxyTelnetOptions(name string, result *[]common.TelnetOption) (err error) {
+	sess, err := self.session(name)
+	if err != nil {
+		return
+	}
+	sess.lock.RLock()
+	defer sess.lock.RUnlock()
+	*result = nil
+	for code := 0; code < 256; code++ {
+		if option, found := sess.telnetOptions[byte(code)]; found {
+			*result = append(*result, *option)
+		}
+	}
+	return
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+func TestNegotiation(t *testing.T) {
+	proxy := New()
+	server := connectServer(t, proxy)
+	for _, test := range []struct {
+		verb     byte
+		option   byte
+		expected []byte
+	}{
+		{common.TelnetWILL, common.TelnetOptionSuppressGoAhead, common.TelnetNegotiate(common.TelnetDO, common.TelnetOptionSuppressGoAhead)},
+		// agreeing again would make servers that answer every DO loop forever, so repeats are ignored, which the
+		// reply to the next request shows
+		{common.TelnetWILL, common.TelnetOptionSuppressGoAhead, nil},
+		{common.TelnetWILL, common.TelnetOptionNAWS, common.TelnetNegotiate(common.TelnetDONT, common.TelnetOptionNAWS)},
+		{common.TelnetWONT, common.TelnetOptionSuppressGoAhead, common.TelnetNegotiate(common.TelnetDONT, common.TelnetOptionSuppressGoAhead)},
+		{common.TelnetWONT, common.TelnetOptionSuppressGoAhead, nil},
+		{common.TelnetDO, common.TelnetOptionTerminalType, common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionTerminalType)},
+		{common.TelnetDO, common.TelnetOptionTerminalType, nil},
+		{common.TelnetDO, common.TelnetOptionEcho, common.TelnetNegotiate(common.TelnetWONT, common.TelnetOptionEcho)},
+		{common.TelnetDONT, common.TelnetOptionTerminalType, common.TelnetNegotiate(common.TelnetWONT, common.TelnetOptionTerminalType)},
+		{common.TelnetDONT, common.TelnetOptionTerminalType, nil},
+		{common.TelnetDONT, common.TelnetOptionEcho, nil},
+		{common.TelnetWILL, common.TelnetOptionEndOfRecord, common.TelnetNegotiate(common.TelnetDO, common.TelnetOptionEndOfRecord)},
+	} {
+		if _, err := server.Write(common.TelnetNegotiate(test.verb, test.option)); err != nil {
+			t.Fatal(err)
+		}
+		if test.expected != nil {
+			expectBytes(t, server, test.expected)
+		}
+	}
+	expectNothing(t, server, time.Second/10)
+	options := []common.TelnetOption{}
+	if err := proxy.ProxyTelnetOptions("", &options); err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range options {
+		if option.Local || option.Remote != (option.Code == common.TelnetOptionEndOfRecord) {
+			t.Fatalf("Wanted only EOR enabled, got %+v", options)
+		}
+	}
+}
+
+func TestNegotiationInText(t *testing.T) {
+	proxy := New()
+	server := connectServer(t, proxy)
+	b := []byte("Hel")
+	b = append(b, common.TelnetIAC, common.TelnetNOP)
+	b = append(b, "lo"...)
+	b = append(b, common.TelnetNegotiate(common.TelnetWILL, common.TelnetOptionEndOfRecord)...)
+	b = append(b, " world\r\n"...)
+	if _, err := server.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	expectBytes(t, server, common.TelnetNegotiate(common.TelnetDO, common.TelnetOptionEndOfRecord))
+	if text := receivedText(t, proxy, len("Hello world\r\n")); text != "Hello world\r\n" {
+		t.Fatalf("Wanted the text without telnet commands, got %q", text)
+	}
+}
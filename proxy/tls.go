@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+const (
+	tlsScheme = "tls://"
+)
+
+var (
+	tlsHandshakeTimeout = 30 * time.Second
+)
+
+func (self *Proxy) TLS(b bool) *Proxy {
+	self.tls = b
+	return self
+}
+
+func (self *Proxy) TLSInsecure(b bool) *Proxy {
+	self.tlsInsecure = b
+	return self
+}
+
+func (self *Proxy) TLSFingerprint(s string) *Proxy {
+	self.tlsFingerprint = normalizeFingerprint(s)
+	return self
+}
+
+func normalizeFingerprint(s string) string {
+	return strings.ToLower(strings.Replace(s, ":", "", -1))
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func (self *Proxy) tlsConfig(addr string) (result *tls.Config, err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	result = &tls.Config{
+		ServerName: host,
+	}
+	if self.tlsFingerprint != "" {
+		// a pinned certificate replaces chain verification, which lets self signed MUD certificates work
+		result.InsecureSkipVerify = true
+		result.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) (err error) {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("No certificate presented by %v", addr)
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return
+			}
+			if found := fingerprint(cert); found != self.tlsFingerprint {
+				return fmt.Errorf("Certificate fingerprint of %v is %v, wanted %v", addr, found, self.tlsFingerprint)
+			}
+			return
+		}
+	} else if self.tlsInsecure {
+		result.InsecureSkipVerify = true
+	}
+	return
+}
+
+// tlsVerified returns whether the server certificate is checked, either against the system roots or a pinned fingerprint.
+func (self *Proxy) tlsVerified() bool {
+	return self.tlsFingerprint != "" || !self.tlsInsecure
+}
+
+// splitTLS returns whether addr (or the proxy configuration) asks for TLS, and addr without any tls:// prefix.
+func (self *Proxy) splitTLS(addr string) (useTLS bool, hostPort string) {
+	if strings.HasPrefix(addr, tlsScheme) {
+		return true, addr[len(tlsScheme):]
+	}
+	return self.tls, addr
+}
+
+func (self *session) startTLS(conn net.Conn, addr string) (result *tls.Conn, err error) {
+	config, err := self.proxy.tlsConfig(addr)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	// a server that never answers the handshake would otherwise hang the connect forever
+	if err = conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		conn.Close()
+		return
+	}
+	result = tls.Client(conn, config)
+	if err = result.Handshake(); err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+	self.log(fmt.Sprintf("TLS connection to %v established: %+v", addr, tlsState(result.ConnectionState(), self.proxy.tlsVerified())))
+	return
+}
+
+func tlsState(state tls.ConnectionState, verified bool) (result common.TLSState) {
+	result = common.TLSState{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+		Verified:    verified,
+	}
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		result.Subject = cert.Subject.String()
+		result.Issuer = cert.Issuer.String()
+		result.NotAfter = cert.NotAfter
+		result.Fingerprint = fingerprint(cert)
+	}
+	return
+}
+
+func (self *Proxy) ProxyTLS(name string, result *common.TLSState) (err error) {
+	sess, err := self.session(name)
+	if err != nil {
+		return
+	}
+	sess.lock.RLock()
+	defer sess.lock.RUnlock()
+	*result = common.TLSState{}
+	if conn, ok := sess.conn.(*tls.Conn); ok {
+		*result = tlsState(conn.ConnectionState(), self.tlsVerified())
+	}
+	return
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+// selfSigned returns a certificate for 127.0.0.1 that no system trusts.
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "moxie test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsServer serves cert at the returned address, greeting every client that completes the handshake.
+func tlsServer(t *testing.T, cert tls.Certificate) string {
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	return listenLocal(t, func(conn net.Conn) {
+		defer conn.Close()
+		server := tls.Server(conn, config)
+		if err := server.Handshake(); err != nil {
+			return
+		}
+		server.Write([]byte("Welcome\n"))
+		// keep the connection until the client is done with it
+		server.Read(make([]byte, 1))
+	})
+}
+
+func certFingerprint(t *testing.T, cert tls.Certificate) string {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fingerprint(parsed)
+}
+
+func TestTLSFingerprint(t *testing.T) {
+	cert := selfSigned(t)
+	addr := tlsServer(t, cert)
+	// pins are accepted the way most tools print them
+	pin := certFingerprint(t, cert)
+	printed := []string{}
+	for index := 0; index < len(pin); index += 2 {
+		printed = append(printed, strings.ToUpper(pin[index:index+2]))
+	}
+	proxy := New().TLSFingerprint(strings.Join(printed, ":"))
+	proxy.consuming = true
+	if err := proxy.ConnectSession(common.DefaultSession, tlsScheme+addr); err != nil {
+		t.Fatal(err)
+	}
+	if text := receivedText(t, proxy, len("Welcome\n")); text != "Welcome\n" {
+		t.Fatalf("Got %q", text)
+	}
+	state := common.TLSState{}
+	if err := proxy.ProxyTLS("", &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Fingerprint != pin || !state.Verified || state.CipherSuite == "" {
+		t.Fatalf("Wanted the pinned certificate verified, got %+v", state)
+	}
+	if status := sessionStatus(t, proxy); status.TLS == nil || *status.TLS != state {
+		t.Fatalf("Wanted %+v in the status, got %+v", state, status.TLS)
+	}
+}
+
+func TestTLSFingerprintMismatch(t *testing.T) {
+	addr := tlsServer(t, selfSigned(t))
+	proxy := New().TLSFingerprint(certFingerprint(t, selfSigned(t)))
+	proxy.consuming = true
+	if err := proxy.ConnectSession(common.DefaultSession, tlsScheme+addr); err == nil || !strings.Contains(err.Error(), "fingerprint") {
+		t.Fatalf("Wanted the certificate rejected for its fingerprint, got %v", err)
+	}
+}
+
+func TestTLSUntrusted(t *testing.T) {
+	addr := tlsServer(t, selfSigned(t))
+	proxy := New().TLS(true)
+	proxy.consuming = true
+	if err := proxy.ConnectSession(common.DefaultSession, addr); err == nil {
+		t.Fatal("Wanted an untrusted certificate rejected")
+	}
+	proxy.TLSInsecure(true)
+	if err := proxy.ConnectSession(common.DefaultSession, addr); err != nil {
+		t.Fatalf("Wanted insecure mode to accept any certificate, got %v", err)
+	}
+	state := common.TLSState{}
+	if err := proxy.ProxyTLS("", &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Verified {
+		t.Fatalf("Wanted the certificate reported as unverified, got %+v", state)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) {
+		tlsHandshakeTimeout = timeout
+	}(tlsHandshakeTimeout)
+	tlsHandshakeTimeout = time.Second / 10
+	// accepts, but never answers the handshake
+	addr := listenLocal(t, func(conn net.Conn) {
+		defer conn.Close()
+		conn.Read(make([]byte, 4096))
+		time.Sleep(time.Second)
+	})
+	proxy := New().TLSInsecure(true)
+	proxy.consuming = true
+	started := time.Now()
+	if err := proxy.ConnectSession(common.DefaultSession, tlsScheme+addr); err == nil {
+		t.Fatal("Wanted the handshake to time out")
+	}
+	if elapsed := time.Now().Sub(started); elapsed > time.Second/2 {
+		t.Fatalf("Wanted the handshake given up after the timeout, took %v", elapsed)
+	}
+}
+
+func TestSplitTLS(t *testing.T) {
+	for _, test := range []struct {
+		tls      bool
+		addr     string
+		useTLS   bool
+		hostPort string
+	}{
+		{false, "mud.example.com:4000", false, "mud.example.com:4000"},
+		{false, "tls://mud.example.com:4001", true, "mud.example.com:4001"},
+		{true, "mud.example.com:4001", true, "mud.example.com:4001"},
+		{true, "tls://mud.example.com:4001", true, "mud.example.com:4001"},
+	} {
+		if useTLS, hostPort := New().TLS(test.tls).splitTLS(test.addr); useTLS != test.useTLS || hostPort != test.hostPort {
+			t.Errorf("Wanted %v with TLS %v to be %v, %v, got %v, %v", test.addr, test.tls, test.useTLS, test.hostPort, useTLS, hostPort)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	upstreamTimeout = 30 * time.Second
+
+	socks5Version        = 5
+	socks5NoAuth         = 0
+	socks5UserPass       = 2
+	socks5NoAcceptable   = 0xff
+	socks5UserPassVer    = 1
+	socks5Connect        = 1
+	socks5IPv4           = 1
+	socks5Domain         = 3
+	socks5IPv6           = 4
+	socks5Succeeded      = 0
+	upstreamSchemeSOCKS5 = "socks5"
+	upstreamSchemeHTTP   = "http"
+)
+
+var socks5Errors = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Upstream makes the proxy connect to servers through a SOCKS5 (socks5://) or HTTP CONNECT (http://) proxy, with the
+// username and password of the URL if it has any. nil connects directly.
+func (self *Proxy) Upstream(u *url.URL) *Proxy {
+	self.upstream = u
+	return self
+}
+
+// dial connects to addr, through the upstream proxy if there is one.
+func (self *Proxy) dial(addr string) (result net.Conn, err error) {
+	if self.upstream == nil {
+		return net.DialTimeout("tcp", addr, upstreamTimeout)
+	}
+	switch self.upstream.Scheme {
+	case upstreamSchemeSOCKS5, upstreamSchemeHTTP:
+	default:
+		err = fmt.Errorf("Unsupported upstream proxy scheme %#v", self.upstream.Scheme)
+		return
+	}
+	if result, err = net.DialTimeout("tcp", self.upstream.Host, upstreamTimeout); err != nil {
+		return
+	}
+	if err = result.SetDeadline(time.Now().Add(upstreamTimeout)); err != nil {
+		result.Close()
+		return
+	}
+	if self.upstream.Scheme == upstreamSchemeSOCKS5 {
+		err = socks5Handshake(result, self.upstream.User, addr)
+	} else {
+		result, err = httpConnect(result, self.upstream.User, addr)
+	}
+	if err == nil {
+		err = result.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		result.Close()
+		err = fmt.Errorf("Unable to connect to %v through %v: %v", addr, self.upstream.Host, err)
+		return
+	}
+	return
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, addr string) (err error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return
+	}
+
+	methods := []byte{socks5NoAuth}
+	if user != nil {
+		methods = append(methods, socks5UserPass)
+	}
+	if err = writeAll(conn, append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("Unexpected SOCKS version %v", reply[0])
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if user == nil {
+			return fmt.Errorf("SOCKS server wants a username and password")
+		}
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return fmt.Errorf("SOCKS username and password must be at most 255 bytes")
+		}
+		auth := []byte{socks5UserPassVer, byte(len(user.Username()))}
+		auth = append(auth, user.Username()...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if err = writeAll(conn, auth); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return
+		}
+		if reply[1] != socks5Succeeded {
+			return fmt.Errorf("SOCKS authentication failed")
+		}
+	case socks5NoAcceptable:
+		return fmt.Errorf("SOCKS server accepts none of our authentication methods")
+	default:
+		return fmt.Errorf("Unexpected SOCKS authentication method %v", reply[1])
+	}
+
+	request := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("Host name %#v too long for SOCKS", host)
+		}
+		request = append(request, socks5Domain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5IPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5IPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if err = writeAll(conn, request); err != nil {
+		return
+	}
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[1] != socks5Succeeded {
+		if msg, found := socks5Errors[header[1]]; found {
+			return fmt.Errorf("SOCKS server: %v", msg)
+		}
+		return fmt.Errorf("SOCKS server failed with %v", header[1])
+	}
+	// skip the address the server bound, which we have no use for
+	skip := 0
+	switch header[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("Unexpected SOCKS address type %v", header[3])
+	}
+	if _, err = io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return
+	}
+	return
+}
+
+// bufferedConn reads through the bufio.Reader used for the HTTP response, in case the server sent more than that.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (self *bufferedConn) Read(b []byte) (int, error) {
+	return self.reader.Read(b)
+}
+
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (result net.Conn, err error) {
+	result = conn
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err = req.Write(conn); err != nil {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return
+	}
+	// the body of a successful CONNECT is the tunnel itself
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("HTTP proxy: %v", resp.Status)
+		return
+	}
+	result = &bufferedConn{
+		Conn:   conn,
+		reader: reader,
+	}
+	return
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func echoServer(t *testing.T) string {
+	return listenLocal(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+}
+
+func tunnel(a, b net.Conn) {
+	go io.Copy(a, b)
+	io.Copy(b, a)
+}
+
+// socks5StandIn accepts CONNECT requests with domain names, requiring the given credentials.
+func socks5StandIn(t *testing.T, username, password string) string {
+	return listenLocal(t, func(conn net.Conn) {
+		defer conn.Close()
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			return
+		}
+		methods := make([]byte, greeting[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		conn.Write([]byte{socks5Version, socks5UserPass})
+		auth := make([]byte, 2)
+		if _, err := io.ReadFull(conn, auth); err != nil {
+			return
+		}
+		user := make([]byte, auth[1])
+		io.ReadFull(conn, user)
+		passwordLength := make([]byte, 1)
+		io.ReadFull(conn, passwordLength)
+		pass := make([]byte, passwordLength[0])
+		io.ReadFull(conn, pass)
+		if string(user) != username || string(pass) != password {
+			conn.Write([]byte{socks5UserPassVer, 1})
+			return
+		}
+		conn.Write([]byte{socks5UserPassVer, socks5Succeeded})
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(conn, header); err != nil || header[3] != socks5Domain {
+			return
+		}
+		host := make([]byte, header[4])
+		io.ReadFull(conn, host)
+		port := make([]byte, 2)
+		io.ReadFull(conn, port)
+		target, err := net.Dial("tcp", net.JoinHostPort(string(host), strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+		if err != nil {
+			conn.Write([]byte{socks5Version, 5, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{socks5Version, socks5Succeeded, 0, socks5IPv4, 127, 0, 0, 1, 0, 0})
+		tunnel(conn, target)
+	})
+}
+
+func httpConnectStandIn(t *testing.T, authorization string) string {
+	return listenLocal(t, func(conn net.Conn) {
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		if req.Header.Get("Proxy-Authorization") != authorization {
+			fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		target, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer target.Close()
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		tunnel(conn, target)
+	})
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	if _, err := conn.Write([]byte("look\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "look\n" {
+		t.Fatalf("Wanted echo, got %#v", string(buf))
+	}
+}
+
+func TestUpstreamSOCKS5(t *testing.T) {
+	_, port, _ := net.SplitHostPort(echoServer(t))
+	addr := net.JoinHostPort("localhost", port)
+	socks := socks5StandIn(t, "moxie", "secret")
+	conn, err := New().Upstream(&url.URL{Scheme: "socks5", User: url.UserPassword("moxie", "secret"), Host: socks}).dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	if _, err = New().Upstream(&url.URL{Scheme: "socks5", User: url.UserPassword("moxie", "wrong"), Host: socks}).dial(addr); err == nil {
+		t.Fatalf("Wanted authentication error")
+	}
+}
+
+func TestUpstreamHTTPConnect(t *testing.T) {
+	addr := echoServer(t)
+	proxy := httpConnectStandIn(t, "Basic bW94aWU6c2VjcmV0")
+	conn, err := New().Upstream(&url.URL{Scheme: "http", User: url.UserPassword("moxie", "secret"), Host: proxy}).dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	if _, err = New().Upstream(&url.URL{Scheme: "http", Host: proxy}).dial(addr); err == nil {
+		t.Fatalf("Wanted authentication error")
+	}
+}
@@ -0,0 +1,100 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Event is something recorded, Offset after the recording started.
+type Event struct {
+	Offset      time.Duration
+	Transmitted bool
+	Data        []byte
+}
+
+// ReadFile reads a recording, in ttyrec format if the name ends with the ttyrec extension and in asciicast otherwise.
+func ReadFile(path string) (result []Event, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if strings.HasSuffix(path, extensions[FormatTTYRec]) {
+		return readTTYRec(bufio.NewReader(file))
+	}
+	return readAsciicast(bufio.NewReader(file))
+}
+
+func readAsciicast(reader *bufio.Reader) (result []Event, err error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+	header := struct {
+		Version int
+	}{}
+	if err = json.Unmarshal(line, &header); err != nil {
+		return
+	}
+	if header.Version != 2 {
+		err = fmt.Errorf("Unsupported asciicast version %v", header.Version)
+		return
+	}
+	for number := 2; ; number++ {
+		if line, err = reader.ReadBytes('\n'); err == io.EOF && len(line) == 0 {
+			err = nil
+			return
+		} else if err != nil && err != io.EOF {
+			return
+		}
+		if strings.TrimSpace(string(line)) == "" {
+			continue
+		}
+		var seconds float64
+		var kind, data string
+		event := []interface{}{&seconds, &kind, &data}
+		if err = json.Unmarshal(line, &event); err != nil {
+			err = fmt.Errorf("Line %v: %v", number, err)
+			return
+		}
+		// resize and marker events mean nothing to a MUD
+		if kind == "o" || kind == "i" {
+			result = append(result, Event{
+				Offset:      time.Duration(seconds * float64(time.Second)),
+				Transmitted: kind == "i",
+				Data:        []byte(data),
+			})
+		}
+	}
+}
+
+func readTTYRec(reader *bufio.Reader) (result []Event, err error) {
+	header := make([]byte, 12)
+	var start time.Time
+	for {
+		if _, err = io.ReadFull(reader, header); err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+		t := time.Unix(int64(binary.LittleEndian.Uint32(header)), int64(binary.LittleEndian.Uint32(header[4:]))*1000)
+		if start.IsZero() {
+			start = t
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(header[8:]))
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return
+		}
+		result = append(result, Event{
+			Offset: t.Sub(start),
+			Data:   data,
+		})
+	}
+}
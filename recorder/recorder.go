@@ -0,0 +1,281 @@
+package recorder
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zond/mdnsrpc"
+	"github.com/zond/moxie/common"
+	"github.com/zond/moxie/metrics"
+)
+
+const (
+	FormatAsciicast = "asciicast"
+	FormatTTYRec    = "ttyrec"
+)
+
+var Formats = []string{
+	FormatAsciicast,
+	FormatTTYRec,
+}
+
+var extensions = map[string]string{
+	FormatAsciicast: ".cast",
+	FormatTTYRec:    ".ttyrec",
+}
+
+const (
+	recordingWidth  = 80
+	recordingHeight = 24
+	fileTimeFormat  = "20060102T150405"
+)
+
+var unsafeFileChars = regexp.MustCompile("[^A-Za-z0-9._-]+")
+
+// safeName turns s into something usable in a file name.
+func safeName(s string) string {
+	return strings.Trim(unsafeFileChars.ReplaceAllString(s, "_"), "_")
+}
+
+// world turns the address of a connection into something usable in a file name.
+func world(addr string) string {
+	if index := strings.Index(addr, "://"); index != -1 {
+		addr = addr[index+3:]
+	}
+	return safeName(addr)
+}
+
+// recording is the file of one connection of a session.
+type recording struct {
+	file   *os.File
+	format string
+	start  time.Time
+}
+
+// createFile creates a new file named after the world, session and start time, numbering it if a file with the same
+// name already exists, so that several recorders or quick reconnects never write to the same file.
+func createFile(dir, format, session, world string, start time.Time) (result *os.File, err error) {
+	parts := []string{world}
+	if name := safeName(session); name != world {
+		parts = append(parts, name)
+	}
+	base := filepath.Join(dir, strings.Join(append(parts, start.Format(fileTimeFormat)), "-"))
+	path := base + extensions[format]
+	for number := 2; ; number++ {
+		if result, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); !os.IsExist(err) {
+			return
+		}
+		path = fmt.Sprintf("%v-%v%v", base, number, extensions[format])
+	}
+}
+
+func newRecording(dir, format, session, world string, start time.Time) (result *recording, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil && !os.IsExist(err) {
+		return
+	}
+	file, err := createFile(dir, format, session, world, start)
+	if err != nil {
+		return
+	}
+	result = &recording{
+		file:   file,
+		format: format,
+		start:  start,
+	}
+	if format == FormatAsciicast {
+		var header []byte
+		if header, err = json.Marshal(map[string]interface{}{
+			"version":   2,
+			"width":     recordingWidth,
+			"height":    recordingHeight,
+			"timestamp": start.Unix(),
+			"title":     world,
+			"env": map[string]string{
+				"TERM": "xterm-256color",
+			},
+		}); err == nil {
+			_, err = file.Write(append(header, '\n'))
+		}
+		if err != nil {
+			file.Close()
+			result = nil
+		}
+	}
+	return
+}
+
+// write records data at t. Asciicast keeps transmitted data as input events, while ttyrec has only output and shows it
+// like a terminal with local echo would.
+func (self *recording) write(t time.Time, transmitted bool, data []byte) (err error) {
+	if t.Before(self.start) {
+		t = self.start
+	}
+	switch self.format {
+	case FormatTTYRec:
+		header := make([]byte, 12)
+		binary.LittleEndian.PutUint32(header, uint32(t.Unix()))
+		binary.LittleEndian.PutUint32(header[4:], uint32(t.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(header[8:], uint32(len(data)))
+		_, err = self.file.Write(append(header, data...))
+	default:
+		kind := "o"
+		if transmitted {
+			kind = "i"
+		}
+		var event []byte
+		if event, err = json.Marshal([]interface{}{math.Round(t.Sub(self.start).Seconds()*1e6) / 1e6, kind, string(data)}); err != nil {
+			return
+		}
+		_, err = self.file.Write(append(event, '\n'))
+	}
+	return
+}
+
+func (self *recording) close() error {
+	return self.file.Close()
+}
+
+// Recorder is a subscriber writing what is received and transmitted by each session to a file per connection.
+type Recorder struct {
+	dir        string
+	format     string
+	recordings map[string]*recording
+	// sessions that disconnected, and get no new recording until they connect again
+	disconnected map[string]bool
+	metrics      *metrics.Registry
+	lock         *sync.Mutex
+}
+
+func New() (result *Recorder) {
+	result = &Recorder{
+		format:       FormatAsciicast,
+		recordings:   map[string]*recording{},
+		disconnected: map[string]bool{},
+		lock:         &sync.Mutex{},
+	}
+	return
+}
+
+// Dir is where to keep the recordings.
+func (self *Recorder) Dir(d string) *Recorder {
+	self.dir = d
+	return self
+}
+
+// Format is one of Formats.
+func (self *Recorder) Format(f string) *Recorder {
+	self.format = f
+	return self
+}
+
+// Metrics makes the recorder record what it does in registry.
+func (self *Recorder) Metrics(registry *metrics.Registry) *Recorder {
+	self.metrics = registry
+	return self
+}
+
+func (self *Recorder) Publish(unused struct{}, unused2 *struct{}) (err error) {
+	done, err := mdnsrpc.Publish(common.Subscriber, self)
+	if err != nil {
+		return
+	}
+
+	<-done
+
+	return
+}
+
+func (self *Recorder) start(session, world string, t time.Time) (result *recording, err error) {
+	if old, found := self.recordings[session]; found {
+		old.close()
+		delete(self.recordings, session)
+	}
+	if result, err = newRecording(self.dir, self.format, session, world, t); err != nil {
+		return
+	}
+	self.recordings[session] = result
+	self.metrics.Add("moxie_recordings_total", "How many recordings were started.", 1, "session", session)
+	log.Printf("Recording %v to %v", session, result.file.Name())
+	return
+}
+
+func (self *Recorder) record(chunk common.Chunk) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	rec, found := self.recordings[chunk.Session]
+	if !found {
+		// like messages about giving up reconnecting, which belong to no connection
+		if self.disconnected[chunk.Session] {
+			return
+		}
+		// started after the session connected, so the address is unknown
+		if rec, err = self.start(chunk.Session, world(chunk.Session), chunk.Time); err != nil {
+			return
+		}
+	}
+	if err = rec.write(chunk.Time, chunk.Transmitted, chunk.Data); err != nil {
+		return
+	}
+	self.metrics.CountChunk(chunk)
+	return
+}
+
+func (self *Recorder) SubscriberTransmit(chunk common.Chunk, unused *struct{}) (err error) {
+	return self.record(chunk)
+}
+
+func (self *Recorder) SubscriberReceive(chunk common.Chunk, unused *struct{}) (err error) {
+	return self.record(chunk)
+}
+
+func (self *Recorder) SubscriberConnected(event common.ConnectionEvent, unused *struct{}) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.disconnected, event.Session)
+	_, err = self.start(event.Session, world(event.Addr), event.Time)
+	return
+}
+
+func (self *Recorder) SubscriberDisconnected(event common.ConnectionEvent, unused *struct{}) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.disconnected[event.Session] = true
+	if rec, found := self.recordings[event.Session]; found {
+		delete(self.recordings, event.Session)
+		return rec.close()
+	}
+	return
+}
+
+func (self *Recorder) SubscriberLine(line common.Line, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Recorder) SubscriberEcho(state common.EchoState, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Recorder) SubscriberGMCP(msg common.GMCPMessage, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Recorder) SubscriberMSDP(variable common.MSDPVariable, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Recorder) SubscriberMSSP(status common.MSSPStatus, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Recorder) SubscriberLog(s string, unused *struct{}) (err error) {
+	return
+}
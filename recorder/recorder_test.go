@@ -0,0 +1,163 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zond/moxie/common"
+)
+
+func TestWorld(t *testing.T) {
+	for addr, expected := range map[string]string{
+		"tls://mud.example.com:4000": "mud.example.com_4000",
+		"10.0.0.1:23":                "10.0.0.1_23",
+		"[::1]:23":                   "1_23",
+	} {
+		if found := world(addr); found != expected {
+			t.Errorf("Wanted %#v for %#v, got %#v", expected, addr, found)
+		}
+	}
+}
+
+func record(t *testing.T, format string) (dir string) {
+	dir = t.TempDir()
+	recorder := New().Dir(dir).Format(format)
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for index, addr := range []string{"mud.example.com:4000", "tls://mud.example.com:4000"} {
+		connected := start.Add(time.Hour * time.Duration(index))
+		if err := recorder.SubscriberConnected(common.ConnectionEvent{Session: "default", Addr: addr, Time: connected}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := recorder.SubscriberReceive(common.Chunk{Session: "default", Data: []byte("Welcome\r\n"), Time: connected.Add(time.Second / 2)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := recorder.SubscriberTransmit(common.Chunk{Session: "default", Data: []byte("look\n"), Transmitted: true, Time: connected.Add(time.Second)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := recorder.SubscriberDisconnected(common.ConnectionEvent{Session: "default", Addr: addr}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func TestRecordingFiles(t *testing.T) {
+	dir := t.TempDir()
+	recorder := New().Dir(dir)
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, event := range []common.ConnectionEvent{
+		{Session: "default", Addr: "mud.example.com:4000", Time: start},
+		{Session: "default", Addr: "mud.example.com:4000", Time: start},
+		{Session: "alt/1", Addr: "mud.example.com:4000", Time: start},
+	} {
+		if err := recorder.SubscriberConnected(event, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := recorder.SubscriberDisconnected(common.ConnectionEvent{Session: "default"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.SubscriberReceive(common.Chunk{Session: "default", Data: []byte("Giving up reconnecting\n"), Time: start}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a recorder started after the session connected records it anyway
+	if err := recorder.SubscriberReceive(common.Chunk{Session: "late", Data: []byte("Welcome\r\n"), Time: start}, nil); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := []string{
+		"late-20200102T030405.cast",
+		"mud.example.com_4000-alt_1-20200102T030405.cast",
+		"mud.example.com_4000-default-20200102T030405-2.cast",
+		"mud.example.com_4000-default-20200102T030405.cast",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Wanted %v, got %v", expected, names)
+	}
+}
+
+func TestAsciicast(t *testing.T) {
+	dir := record(t, FormatAsciicast)
+	for _, name := range []string{"mud.example.com_4000-default-20200102T030405.cast", "mud.example.com_4000-default-20200102T040405.cast"} {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("Wanted header and two events, got %#v", lines)
+		}
+		header := map[string]interface{}{}
+		if err = json.Unmarshal([]byte(lines[0]), &header); err != nil {
+			t.Fatal(err)
+		}
+		if header["version"] != float64(2) || header["title"] != "mud.example.com_4000" {
+			t.Fatalf("Wrong header %v", header)
+		}
+		for index, expected := range []string{`[0.5,"o","Welcome\r\n"]`, `[1,"i","look\n"]`} {
+			if lines[index+1] != expected {
+				t.Errorf("Wanted %v, got %v", expected, lines[index+1])
+			}
+		}
+	}
+}
+
+func TestTTYRec(t *testing.T) {
+	dir := record(t, FormatTTYRec)
+	b, err := os.ReadFile(filepath.Join(dir, "mud.example.com_4000-default-20200102T030405.ttyrec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"Welcome\r\n", "look\n"} {
+		if len(b) < 12 {
+			t.Fatalf("Wanted record header, got %v", b)
+		}
+		sec, usec, length := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:]), binary.LittleEndian.Uint32(b[8:])
+		if int(length) != len(expected) || !bytes.Equal(b[12:12+length], []byte(expected)) {
+			t.Fatalf("Wanted %#v, got %#v", expected, string(b[12:]))
+		}
+		if sec != uint32(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC).Unix()) && sec != uint32(time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC).Unix()) {
+			t.Fatalf("Wrong time %v.%v", sec, usec)
+		}
+		b = b[12+length:]
+	}
+	if len(b) != 0 {
+		t.Fatalf("Wanted nothing more, got %v", b)
+	}
+}
+
+func TestPlayback(t *testing.T) {
+	for format, expected := range map[string][]Event{
+		FormatAsciicast: {
+			{Offset: time.Second / 2, Data: []byte("Welcome\r\n")},
+			{Offset: time.Second, Transmitted: true, Data: []byte("look\n")},
+		},
+		FormatTTYRec: {
+			{Offset: 0, Data: []byte("Welcome\r\n")},
+			{Offset: time.Second / 2, Data: []byte("look\n")},
+		},
+	} {
+		dir := record(t, format)
+		events, err := ReadFile(filepath.Join(dir, "mud.example.com_4000-default-20200102T030405"+extensions[format]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Errorf("Wanted %+v for %v, got %+v", expected, format, events)
+		}
+	}
+}
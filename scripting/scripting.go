@@ -39,13 +39,62 @@ func (self *ReceiveHookHandle) Unregister() {
 	handler.unregisterReceiveHook(self.name)
 }
 
+type GMCPHookHandle struct {
+	name  string
+	pkg   string
+	fun   func(common.GMCPMessage)
+	times int
+}
+
+func (self *GMCPHookHandle) Unregister() {
+	handler.unregisterGMCPHook(self.name)
+}
+
+type MSDPHookHandle struct {
+	name     string
+	variable string
+	fun      func(common.MSDPVariable)
+	times    int
+}
+
+func (self *MSDPHookHandle) Unregister() {
+	handler.unregisterMSDPHook(self.name)
+}
+
+type LineHookHandle struct {
+	name   string
+	regexp *regexp.Regexp
+	fun    func(common.Line, []string)
+	times  int
+}
+
+func (self *LineHookHandle) Unregister() {
+	handler.unregisterLineHook(self.name)
+}
+
+type ConnectionHookHandle struct {
+	name      string
+	connected bool
+}
+
+func (self *ConnectionHookHandle) Unregister() {
+	handler.unregisterConnectionHook(self.name, self.connected)
+}
+
 type interruptHandler struct {
 	lock                   *sync.RWMutex
 	consumptionInterrupts  map[string]func(string)
 	transmissionInterrupts map[string]func([]string)
 	receiveHooks           map[string]*ReceiveHookHandle
+	gmcpHooks              map[string]*GMCPHookHandle
+	msdpHooks              map[string]*MSDPHookHandle
+	lineHooks              map[string]*LineHookHandle
+	parsers                map[string]*common.ANSIParser
+	connectedHooks         map[string]func(common.ConnectionEvent)
+	disconnectedHooks      map[string]func(common.ConnectionEvent)
 	addr                   *net.TCPAddr
 	published              bool
+	session                string
 }
 
 func MustTransmit(s ...string) {
@@ -97,21 +146,45 @@ func MustReceiveHookHandle(h *ReceiveHookHandle, err error) *ReceiveHookHandle {
 	return h
 }
 
-func (self *interruptHandler) SubscriberTransmit(b []byte, unused *struct{}) (err error) {
+// attachedTo returns whether events from the named session should reach the hooks. Callers must hold at least a read
+// lock.
+func (self *interruptHandler) attachedTo(session string) bool {
+	return self.session == "" || self.session == session
+}
+
+func (self *interruptHandler) SubscriberTransmit(chunk common.Chunk, unused *struct{}) (err error) {
 	return
 }
 
-func (self *interruptHandler) SubscriberReceive(b []byte, unused *struct{}) (err error) {
+func (self *interruptHandler) SubscriberReceive(chunk common.Chunk, unused *struct{}) (err error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
+	if !self.attachedTo(chunk.Session) {
+		return
+	}
+	parser, found := self.parsers[chunk.Session]
+	if !found {
+		parser = &common.ANSIParser{}
+		self.parsers[chunk.Session] = parser
+	}
+	self.receive(parser.Parse(chunk.Data).Plain())
+	return
+}
+
+// receive runs the receive hooks matching text, which has no escape sequences. Callers must hold the lock.
+func (self *interruptHandler) receive(text string) {
 	for name, hook := range self.receiveHooks {
-		if match := hook.regexp.FindStringSubmatch(string(b)); match != nil {
+		if match := hook.regexp.FindStringSubmatch(text); match != nil {
 			self.lock.Unlock()
 			func() {
 				defer self.lock.Lock()
 				hook.fun(match[hook.contentGroup:hook.afterGroup])
 			}()
-			go self.SubscriberReceive([]byte(match[hook.beforeGroup]+match[hook.afterGroup]), nil)
+			go func() {
+				self.lock.Lock()
+				defer self.lock.Unlock()
+				self.receive(match[hook.beforeGroup] + match[hook.afterGroup])
+			}()
 			if hook.times != 0 {
 				hook.times -= 1
 				if hook.times == 0 {
@@ -120,6 +193,111 @@ func (self *interruptHandler) SubscriberReceive(b []byte, unused *struct{}) (err
 			}
 		}
 	}
+}
+
+func (self *interruptHandler) SubscriberLine(line common.Line, unused *struct{}) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.attachedTo(line.Session) {
+		return
+	}
+	for name, hook := range self.lineHooks {
+		if match := hook.regexp.FindStringSubmatch(common.StripANSI(line.Text)); match != nil {
+			self.lock.Unlock()
+			func() {
+				defer self.lock.Lock()
+				hook.fun(line, match)
+			}()
+			if hook.times != 0 {
+				hook.times -= 1
+				if hook.times == 0 {
+					delete(self.lineHooks, name)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (self *interruptHandler) SubscriberEcho(state common.EchoState, unused *struct{}) (err error) {
+	return
+}
+
+func (self *interruptHandler) SubscriberGMCP(msg common.GMCPMessage, unused *struct{}) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.attachedTo(msg.Session) {
+		return
+	}
+	for name, hook := range self.gmcpHooks {
+		if msg.Matches(hook.pkg) {
+			self.lock.Unlock()
+			func() {
+				defer self.lock.Lock()
+				hook.fun(msg)
+			}()
+			if hook.times != 0 {
+				hook.times -= 1
+				if hook.times == 0 {
+					delete(self.gmcpHooks, name)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (self *interruptHandler) SubscriberMSDP(variable common.MSDPVariable, unused *struct{}) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.attachedTo(variable.Session) {
+		return
+	}
+	for name, hook := range self.msdpHooks {
+		if hook.variable == variable.Name {
+			self.lock.Unlock()
+			func() {
+				defer self.lock.Lock()
+				hook.fun(variable)
+			}()
+			if hook.times != 0 {
+				hook.times -= 1
+				if hook.times == 0 {
+					delete(self.msdpHooks, name)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (self *interruptHandler) SubscriberMSSP(status common.MSSPStatus, unused *struct{}) (err error) {
+	return
+}
+
+func (self *interruptHandler) runConnectionHooks(hooks map[string]func(common.ConnectionEvent), event common.ConnectionEvent) {
+	self.lock.RLock()
+	if !self.attachedTo(event.Session) {
+		self.lock.RUnlock()
+		return
+	}
+	toRun := []func(common.ConnectionEvent){}
+	for _, hook := range hooks {
+		toRun = append(toRun, hook)
+	}
+	self.lock.RUnlock()
+	for _, hook := range toRun {
+		hook(event)
+	}
+}
+
+func (self *interruptHandler) SubscriberConnected(event common.ConnectionEvent, unused *struct{}) (err error) {
+	self.runConnectionHooks(self.connectedHooks, event)
+	return
+}
+
+func (self *interruptHandler) SubscriberDisconnected(event common.ConnectionEvent, unused *struct{}) (err error) {
+	self.runConnectionHooks(self.disconnectedHooks, event)
 	return
 }
 
@@ -180,6 +358,78 @@ func (self *interruptHandler) registerReceiveHook(hook *ReceiveHookHandle) (err
 	return
 }
 
+func (self *interruptHandler) unregisterGMCPHook(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.gmcpHooks, name)
+}
+
+func (self *interruptHandler) registerGMCPHook(hook *GMCPHookHandle) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err = self.publish(); err != nil {
+		return
+	}
+	self.gmcpHooks[hook.name] = hook
+	return
+}
+
+func (self *interruptHandler) unregisterLineHook(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.lineHooks, name)
+}
+
+func (self *interruptHandler) registerLineHook(hook *LineHookHandle) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err = self.publish(); err != nil {
+		return
+	}
+	self.lineHooks[hook.name] = hook
+	return
+}
+
+func (self *interruptHandler) unregisterMSDPHook(name string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.msdpHooks, name)
+}
+
+func (self *interruptHandler) registerMSDPHook(hook *MSDPHookHandle) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err = self.publish(); err != nil {
+		return
+	}
+	self.msdpHooks[hook.name] = hook
+	return
+}
+
+func (self *interruptHandler) unregisterConnectionHook(name string, connected bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if connected {
+		delete(self.connectedHooks, name)
+	} else {
+		delete(self.disconnectedHooks, name)
+	}
+}
+
+func (self *interruptHandler) registerConnectionHook(name string, connected bool, f func(common.ConnectionEvent)) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err = self.publish(); err != nil {
+		return
+	}
+	if connected {
+		self.connectedHooks[name] = f
+	} else {
+		self.disconnectedHooks[name] = f
+	}
+	return
+}
+
 func (self *interruptHandler) registerTransmissionInterrupt(name string, f func([]string)) (err error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
@@ -213,11 +463,31 @@ func (self *interruptHandler) registerConsumptionInterrupt(name string, f func(s
 	return
 }
 
+// Attach makes the script talk to the named session, and only run hooks for events from it. Without it the script
+// talks to the default session and hooks run for events from all sessions.
+func Attach(name string) {
+	handler.lock.Lock()
+	defer handler.lock.Unlock()
+	handler.session = name
+}
+
+func attached() string {
+	handler.lock.RLock()
+	defer handler.lock.RUnlock()
+	return handler.session
+}
+
 var handler = interruptHandler{
-	lock: &sync.RWMutex{},
+	lock:                   &sync.RWMutex{},
 	consumptionInterrupts:  map[string]func(string){},
 	transmissionInterrupts: map[string]func([]string){},
 	receiveHooks:           map[string]*ReceiveHookHandle{},
+	gmcpHooks:              map[string]*GMCPHookHandle{},
+	msdpHooks:              map[string]*MSDPHookHandle{},
+	lineHooks:              map[string]*LineHookHandle{},
+	parsers:                map[string]*common.ANSIParser{},
+	connectedHooks:         map[string]func(common.ConnectionEvent){},
+	disconnectedHooks:      map[string]func(common.ConnectionEvent){},
 }
 
 func interruptConsumption(interrupt common.ConsumptionInterrupt, h func(string)) (err error) {
@@ -237,6 +507,36 @@ func interruptConsumption(interrupt common.ConsumptionInterrupt, h func(string))
 	return
 }
 
+// Highlight makes all consumers show what pattern matches, or the whole line if wholeLine, with the style of the SGR
+// parameters sgr, like "1;33" for bold yellow. The highlight replaces any other with the same name, and is saved by
+// the consumers, so it stays after this script is gone.
+func Highlight(name, pattern, sgr string, wholeLine bool) (err error) {
+	highlight := common.Highlight{
+		Name:      name,
+		Pattern:   pattern,
+		WholeLine: wholeLine,
+	}
+	highlight.Style.Apply(sgr)
+	return callConsumers(common.ConsumerHighlight, highlight)
+}
+
+func Unhighlight(name string) (err error) {
+	return callConsumers(common.ConsumerUnhighlight, name)
+}
+
+func callConsumers(method string, arg interface{}) (err error) {
+	consumers, err := mdnsrpc.LookupAll(common.Consumer)
+	if err != nil {
+		return
+	}
+	for _, client := range consumers {
+		if err = client.Call(method, arg, nil); err != nil {
+			return
+		}
+	}
+	return
+}
+
 func InterruptConsumptionN(n int, name, pattern string, handler func(string)) (err error) {
 	return interruptConsumption(common.ConsumptionInterrupt{
 		Name:    name,
@@ -316,19 +616,247 @@ func ReceiveHookN(times int, name, pattern string, h func([]string)) (result *Re
 	return
 }
 
+// LineHook runs h with every complete line or prompt from the server matching pattern, and the submatches of pattern.
+// Unlike ReceiveHook it never misses matches split between reads. Like ReceiveHook, pattern matches the text without
+// escape sequences, so colors do not get in the way.
+func LineHook(name, pattern string, h func(common.Line, []string)) (result *LineHookHandle, err error) {
+	return LineHookN(0, name, pattern, h)
+}
+
+func LineHookOnce(name, pattern string, h func(common.Line, []string)) (result *LineHookHandle, err error) {
+	return LineHookN(1, name, pattern, h)
+}
+
+func LineHookN(times int, name, pattern string, h func(common.Line, []string)) (result *LineHookHandle, err error) {
+	reg, err := regexp.Compile(pattern)
+	if err != nil {
+		return
+	}
+	result = &LineHookHandle{
+		name:   name,
+		regexp: reg,
+		fun:    h,
+		times:  times,
+	}
+	if err = handler.registerLineHook(result); err != nil {
+		return
+	}
+	return
+}
+
+func GMCPHook(name, pkg string, h func(common.GMCPMessage)) (result *GMCPHookHandle, err error) {
+	return GMCPHookN(0, name, pkg, h)
+}
+
+func GMCPHookOnce(name, pkg string, h func(common.GMCPMessage)) (result *GMCPHookHandle, err error) {
+	return GMCPHookN(1, name, pkg, h)
+}
+
+func GMCPHookN(times int, name, pkg string, h func(common.GMCPMessage)) (result *GMCPHookHandle, err error) {
+	result = &GMCPHookHandle{
+		name:  name,
+		pkg:   pkg,
+		fun:   h,
+		times: times,
+	}
+	if err = handler.registerGMCPHook(result); err != nil {
+		return
+	}
+	return
+}
+
+func TransmitGMCP(pkg string, data interface{}) (err error) {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	msg := common.GMCPMessage{
+		Session: attached(),
+		Package: pkg,
+	}
+	// round trip through JSON so that gob only sees the types it knows how to send as interface{}
+	if data != nil {
+		if err = (common.GMCPMessage{Data: data}).Decode(&msg.Data); err != nil {
+			return
+		}
+	}
+	return client.Call(common.ProxyTransmitGMCP, msg, nil)
+}
+
+func MSDPHook(name, variable string, h func(common.MSDPVariable)) (result *MSDPHookHandle, err error) {
+	return MSDPHookN(0, name, variable, h)
+}
+
+func MSDPHookOnce(name, variable string, h func(common.MSDPVariable)) (result *MSDPHookHandle, err error) {
+	return MSDPHookN(1, name, variable, h)
+}
+
+func MSDPHookN(times int, name, variable string, h func(common.MSDPVariable)) (result *MSDPHookHandle, err error) {
+	result = &MSDPHookHandle{
+		name:     name,
+		variable: variable,
+		fun:      h,
+		times:    times,
+	}
+	if err = handler.registerMSDPHook(result); err != nil {
+		return
+	}
+	return
+}
+
+func TransmitMSDP(variables ...common.MSDPVariable) (err error) {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	session := attached()
+	for index := range variables {
+		if variables[index].Session == "" {
+			variables[index].Session = session
+		}
+	}
+	return client.Call(common.ProxyTransmitMSDP, variables, nil)
+}
+
+func MSDPCommand(command string, variables ...string) (err error) {
+	return TransmitMSDP(common.MSDPVariable{
+		Name:  command,
+		Value: common.MSDPStrings(variables...),
+	})
+}
+
+func MSDPReport(variables ...string) (err error) {
+	return MSDPCommand("REPORT", variables...)
+}
+
+func MSDPUnreport(variables ...string) (err error) {
+	return MSDPCommand("UNREPORT", variables...)
+}
+
+func MSDPSend(variables ...string) (err error) {
+	return MSDPCommand("SEND", variables...)
+}
+
+func MSDP() (result map[string]common.MSDPValue, err error) {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	if err = client.Call(common.ProxyMSDP, attached(), &result); err != nil {
+		return
+	}
+	return
+}
+
+func MSSP() (result map[string][]string, err error) {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	if err = client.Call(common.ProxyMSSP, attached(), &result); err != nil {
+		return
+	}
+	return
+}
+
+// ConnectedHook runs h every time the proxy connects to the server, for example to log in again after a reconnect.
+func ConnectedHook(name string, h func(common.ConnectionEvent)) (result *ConnectionHookHandle, err error) {
+	result = &ConnectionHookHandle{
+		name:      name,
+		connected: true,
+	}
+	if err = handler.registerConnectionHook(name, true, h); err != nil {
+		return
+	}
+	return
+}
+
+func DisconnectedHook(name string, h func(common.ConnectionEvent)) (result *ConnectionHookHandle, err error) {
+	result = &ConnectionHookHandle{
+		name: name,
+	}
+	if err = handler.registerConnectionHook(name, false, h); err != nil {
+		return
+	}
+	return
+}
+
 func TransmitMany(lines []string) (err error) {
 	client, err := mdnsrpc.LookupOne(common.Proxy)
 	if err != nil {
 		return
 	}
+	session := attached()
 	for _, line := range lines {
-		if err = client.Call(common.ProxyTransmit, line+"\n", nil); err != nil {
+		if err = client.Call(common.ProxyTransmit, common.Chunk{
+			Session: session,
+			Data:    []byte(line + "\n"),
+		}, nil); err != nil {
 			return
 		}
 	}
 	return
 }
 
+func TelnetOptions() (result []common.TelnetOption, err error) {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	if err = client.Call(common.ProxyTelnetOptions, attached(), &result); err != nil {
+		return
+	}
+	return
+}
+
+// TransmitNow sends s ahead of any queued commands, for example to flee, without waiting for the pacing of the proxy.
+func TransmitNow(s string) (err error) {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	return client.Call(common.ProxyTransmitNow, common.Chunk{
+		Session: attached(),
+		Data:    []byte(s + "\n"),
+	}, nil)
+}
+
+// CommandQueue returns the commands waiting to be sent.
+func CommandQueue() (result []common.Chunk, err error) {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	if err = client.Call(common.ProxyCommandQueue, attached(), &result); err != nil {
+		return
+	}
+	return
+}
+
+// FlushCommandQueue drops the commands waiting to be sent, and returns them.
+func FlushCommandQueue() (result []common.Chunk, err error) {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	if err = client.Call(common.ProxyFlushCommandQueue, attached(), &result); err != nil {
+		return
+	}
+	return
+}
+
+// DeliveryStats returns how far behind each consumer and subscriber of the proxy is.
+func DeliveryStats() (result []common.DeliveryStats, err error) {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	if err = client.Call(common.ProxyDeliveryStats, struct{}{}, &result); err != nil {
+		return
+	}
+	return
+}
+
 func TransmitAndInterruptN(n int, trans string, pattern string, h func(string)) (err error) {
 	if err = interruptConsumption(common.ConsumptionInterrupt{
 		Name:    fmt.Sprint(rand.Int63()),
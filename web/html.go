@@ -0,0 +1,112 @@
+package web
+
+import (
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/zond/moxie/common"
+)
+
+const (
+	defaultForeground = "#aaaaaa"
+	defaultBackground = "#000000"
+)
+
+// the VGA palette most MUD clients use
+var ansiColors = [16]string{
+	"#000000", "#aa0000", "#00aa00", "#aa5500", "#0000aa", "#aa00aa", "#00aaaa", "#aaaaaa",
+	"#555555", "#ff5555", "#55ff55", "#ffff55", "#5555ff", "#ff55ff", "#55ffff", "#ffffff",
+}
+
+var cubeLevels = [6]int{0, 95, 135, 175, 215, 255}
+
+func color256(n int) string {
+	switch {
+	case n < 16:
+		return ansiColors[n]
+	case n < 232:
+		n -= 16
+		return fmt.Sprintf("#%02x%02x%02x", cubeLevels[n/36], cubeLevels[n/6%6], cubeLevels[n%6])
+	default:
+		gray := 8 + 10*(n-232)
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+	}
+}
+
+// colorCSS returns the CSS color of c, or nothing for the default color. Bold makes the basic colors bright.
+func colorCSS(c common.Color, bold bool) string {
+	switch c.Mode {
+	case common.ColorBasic:
+		if bold {
+			return ansiColors[c.Index+8]
+		}
+		return ansiColors[c.Index]
+	case common.ColorBright:
+		return ansiColors[c.Index+8]
+	case common.Color256:
+		return color256(int(c.Index))
+	case common.ColorRGB:
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return ""
+}
+
+func styleCSS(style common.Style) string {
+	properties := []string{}
+	foreground, background := colorCSS(style.Foreground, style.Bold), colorCSS(style.Background, false)
+	if style.Inverse {
+		if foreground == "" {
+			foreground = defaultForeground
+		}
+		if background == "" {
+			background = defaultBackground
+		}
+		foreground, background = background, foreground
+	}
+	if foreground != "" {
+		properties = append(properties, "color:"+foreground)
+	}
+	if background != "" {
+		properties = append(properties, "background-color:"+background)
+	}
+	if style.Bold {
+		properties = append(properties, "font-weight:bold")
+	}
+	if style.Faint {
+		properties = append(properties, "opacity:0.7")
+	}
+	if style.Italic {
+		properties = append(properties, "font-style:italic")
+	}
+	decorations := []string{}
+	if style.Underline {
+		decorations = append(decorations, "underline")
+	}
+	if style.Strikethrough {
+		decorations = append(decorations, "line-through")
+	}
+	if len(decorations) > 0 {
+		properties = append(properties, "text-decoration:"+strings.Join(decorations, " "))
+	}
+	return strings.Join(properties, ";")
+}
+
+// carriage returns and bells mean nothing in a browser
+var browserIgnored = strings.NewReplacer("\r", "", "\a", "")
+
+func toHTML(text common.StyledText) string {
+	result := &strings.Builder{}
+	for _, span := range text {
+		escaped := html.EscapeString(browserIgnored.Replace(span.Text))
+		if escaped == "" {
+			continue
+		}
+		if css := styleCSS(span.Style); css == "" {
+			result.WriteString(escaped)
+		} else {
+			fmt.Fprintf(result, `<span style="%v">%v</span>`, css, escaped)
+		}
+	}
+	return result.String()
+}
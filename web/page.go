@@ -0,0 +1,114 @@
+package web
+
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>moxie</title>
+<style>
+html, body { height: 100%; margin: 0; background: #000000; color: #aaaaaa; font-family: monospace; }
+body { display: flex; flex-direction: column; }
+#output { flex: 1; overflow-y: auto; white-space: pre-wrap; word-wrap: break-word; padding: 4px; }
+#output .log { color: #55ffff; }
+#input { font: inherit; background: #111111; color: #ffffff; border: none; border-top: 1px solid #555555; padding: 4px; outline: none; }
+</style>
+</head>
+<body>
+<div id="output"></div>
+<input id="input" type="text" autocomplete="off" autofocus>
+<script>
+(function() {
+	var output = document.getElementById("output");
+	var input = document.getElementById("input");
+	var history = [];
+	var position = 0;
+	var masked = false;
+	var socket = null;
+	var maxLines = 5000;
+
+	function append(node) {
+		var follow = output.scrollTop + output.clientHeight >= output.scrollHeight - 4;
+		output.appendChild(node);
+		while (output.childNodes.length > maxLines) {
+			output.removeChild(output.firstChild);
+		}
+		if (follow) {
+			output.scrollTop = output.scrollHeight;
+		}
+	}
+
+	function appendHTML(html) {
+		var span = document.createElement("span");
+		span.innerHTML = html;
+		append(span);
+	}
+
+	function appendLog(text) {
+		var div = document.createElement("div");
+		div.className = "log";
+		div.textContent = text;
+		append(div);
+	}
+
+	function connect() {
+		socket = new WebSocket((location.protocol == "https:" ? "wss://" : "ws://") + location.host + "/ws");
+		socket.onmessage = function(ev) {
+			var msg = JSON.parse(ev.data);
+			switch (msg.type) {
+			case "output":
+				appendHTML(msg.html);
+				break;
+			case "log":
+				appendLog(msg.text);
+				break;
+			case "echo":
+				masked = msg.masked;
+				input.type = masked ? "password" : "text";
+				break;
+			case "history":
+				history = msg.entries || [];
+				position = history.length;
+				break;
+			}
+		};
+		socket.onclose = function() {
+			appendLog("Disconnected, reconnecting...");
+			setTimeout(connect, 2000);
+		};
+	}
+
+	input.addEventListener("keydown", function(ev) {
+		switch (ev.key) {
+		case "Enter":
+			if (socket && socket.readyState == WebSocket.OPEN) {
+				socket.send(JSON.stringify({type: "command", text: input.value}));
+				if (!masked && input.value != "") {
+					history.push(input.value);
+				}
+				position = history.length;
+				input.value = "";
+			}
+			break;
+		case "ArrowUp":
+			if (position > 0) {
+				position--;
+				input.value = history[position];
+			}
+			ev.preventDefault();
+			break;
+		case "ArrowDown":
+			if (position < history.length) {
+				position++;
+				input.value = position < history.length ? history[position] : "";
+			}
+			ev.preventDefault();
+			break;
+		}
+	});
+
+	connect();
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,446 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/zond/mdnsrpc"
+	"github.com/zond/moxie/common"
+	"github.com/zond/moxie/consumer"
+	"github.com/zond/moxie/controller"
+	"github.com/zond/moxie/metrics"
+)
+
+const (
+	clientQueueSize = 1024
+	historyEntries  = 500
+)
+
+const (
+	messageOutput  = "output"
+	messageLog     = "log"
+	messageEcho    = "echo"
+	messageHistory = "history"
+	messageCommand = "command"
+)
+
+// message is what goes through the WebSocket, in both directions.
+type message struct {
+	Type    string   `json:"type"`
+	Session string   `json:"session,omitempty"`
+	HTML    string   `json:"html,omitempty"`
+	Text    string   `json:"text,omitempty"`
+	Masked  bool     `json:"masked"`
+	Entries []string `json:"entries,omitempty"`
+}
+
+// output is a converted chunk, kept with the chunk so that replayed chunks can be recognized.
+type output struct {
+	chunk   common.Chunk
+	encoded []byte
+}
+
+type webClient struct {
+	ws        *websocket
+	out       chan []byte
+	replaying bool
+	pending   []output
+	replayed  common.Chunk
+}
+
+// Web serves a page showing the output of the proxy, and sends what is typed into it to the proxy.
+type Web struct {
+	*consumer.Interrupts
+	*consumer.Highlights
+	dir     string
+	session string
+	addr    string
+	replay  int
+	history *controller.History
+	parsers map[string]*common.ANSIParser
+	clients map[*webClient]bool
+	masked  bool
+	metrics *metrics.Registry
+	lock    *sync.RWMutex
+}
+
+func New() (result *Web) {
+	result = &Web{
+		Highlights: consumer.NewHighlights(),
+		addr:       "localhost:8080",
+		parsers:    map[string]*common.ANSIParser{},
+		clients:    map[*webClient]bool{},
+		lock:       &sync.RWMutex{},
+	}
+	result.Interrupts = consumer.NewInterrupts(func(s string) {
+		result.Log(s, nil)
+	})
+	return
+}
+
+// Dir is where the history shared with the controller is kept.
+func (self *Web) Dir(d string) *Web {
+	self.dir = d
+	return self
+}
+
+// Session makes the page show only the output of the named session, and send input to it instead of the default one.
+func (self *Web) Session(name string) *Web {
+	self.session = name
+	return self
+}
+
+// Addr is where to serve the page, like host:port.
+func (self *Web) Addr(addr string) *Web {
+	self.addr = addr
+	return self
+}
+
+// Replay makes new pages start by showing the last lines received by the proxy.
+func (self *Web) Replay(lines int) *Web {
+	self.replay = lines
+	return self
+}
+
+// Metrics makes the page record what it does in registry.
+func (self *Web) Metrics(registry *metrics.Registry) *Web {
+	self.metrics = registry
+	self.Interrupts.Metrics(registry)
+	return self
+}
+
+func (self *Web) Publish(unused struct{}, unused2 *struct{}) (err error) {
+	if self.history, err = controller.NewHistory(self.dir); err != nil {
+		return
+	}
+	if err = self.Load(self.dir); err != nil {
+		return
+	}
+	if _, err = mdnsrpc.Publish(common.Consumer, self); err != nil {
+		return
+	}
+	if _, err = mdnsrpc.Publish(common.Subscriber, self); err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", self.servePage)
+	mux.HandleFunc("/ws", self.serveWebsocket)
+	self.Log(fmt.Sprintf("Serving the web client at http://%v/", self.addr), nil)
+	return http.ListenAndServe(self.addr, mux)
+}
+
+func (self *Web) Log(s string, unused *struct{}) (err error) {
+	loggers, err := mdnsrpc.LookupAll(common.Subscriber)
+	if err != nil {
+		return
+	}
+	if len(loggers) == 0 {
+		log.Printf("%v", s)
+	} else {
+		for _, client := range loggers {
+			if err := self.metrics.Call(client, common.SubscriberLog, s, nil); err != nil {
+				log.Printf("%v", err.Error())
+			}
+		}
+	}
+	return
+}
+
+func (self *Web) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, page)
+}
+
+func encode(msg message) []byte {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		// only strings, bools and string slices, which always marshal
+		panic(err)
+	}
+	return b
+}
+
+// send queues b for the client, and drops the client if it can't keep up. Callers must hold the lock.
+func (self *Web) send(client *webClient, b []byte) {
+	select {
+	case client.out <- b:
+	default:
+		log.Printf("Web client %v too slow, dropping it", client.ws.conn.RemoteAddr())
+		self.unregister(client)
+	}
+}
+
+// unregister stops the writer of the client. Callers must hold the lock.
+func (self *Web) unregister(client *webClient) {
+	if self.clients[client] {
+		delete(self.clients, client)
+		close(client.out)
+		client.ws.Close()
+	}
+}
+
+func (self *Web) broadcast(msg message) {
+	b := encode(msg)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for client := range self.clients {
+		self.send(client, b)
+	}
+}
+
+func (self *Web) write(client *webClient) {
+	for b := range client.out {
+		if err := client.ws.writeText(b); err != nil {
+			break
+		}
+	}
+	client.ws.Close()
+}
+
+// replayScrollback sends the last lines of the proxy to a client registered as replaying, and then what arrived
+// meanwhile.
+func (self *Web) replayScrollback(client *webClient) (err error) {
+	chunks := []common.Chunk{}
+	if self.replay > 0 {
+		var proxy *mdnsrpc.Client
+		if proxy, err = mdnsrpc.LookupOne(common.Proxy); err == nil {
+			err = self.metrics.Call(proxy, common.ProxyScrollback, common.ScrollbackRequest{
+				Session: self.session,
+				Lines:   self.replay,
+			}, &chunks)
+		}
+	}
+	parsers := map[string]*common.ANSIParser{}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.clients[client] {
+		return
+	}
+	for _, chunk := range chunks {
+		parser, found := parsers[chunk.Session]
+		if !found {
+			parser = &common.ANSIParser{}
+			parsers[chunk.Session] = parser
+		}
+		self.send(client, encode(message{
+			Type:    messageOutput,
+			Session: chunk.Session,
+			HTML:    toHTML(self.Apply(parser.Parse(chunk.Data))),
+		}))
+		client.replayed = chunk
+	}
+	for _, o := range client.pending {
+		// spilled scrollback can be older than a restart of the proxy, so only chunks that are not newer count
+		if o.chunk.Seq > client.replayed.Seq || o.chunk.Time.After(client.replayed.Time) {
+			self.send(client, o.encoded)
+		}
+	}
+	client.pending = nil
+	client.replaying = false
+	return
+}
+
+func (self *Web) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrade(w, r)
+	if err != nil {
+		self.Log(err.Error(), nil)
+		return
+	}
+	client := &webClient{
+		ws:        ws,
+		out:       make(chan []byte, clientQueueSize),
+		replaying: true,
+	}
+	go self.write(client)
+	entries, err := self.history.Last(historyEntries)
+	if err != nil {
+		self.Log(fmt.Sprintf("Unable to load history: %v", err), nil)
+	}
+	self.lock.Lock()
+	self.clients[client] = true
+	self.send(client, encode(message{
+		Type:    messageHistory,
+		Entries: entries,
+	}))
+	self.lock.Unlock()
+	self.updateMasked()
+	self.lock.Lock()
+	self.send(client, encode(message{
+		Type:   messageEcho,
+		Masked: self.masked,
+	}))
+	self.lock.Unlock()
+	if err = self.replayScrollback(client); err != nil {
+		self.Log(fmt.Sprintf("Unable to replay scrollback: %v", err), nil)
+	}
+	self.Log(fmt.Sprintf("Web client connected from %v", r.RemoteAddr), nil)
+	for {
+		b, err := ws.readMessage()
+		if err != nil {
+			if err != io.EOF {
+				self.Log(fmt.Sprintf("Web client %v: %v", r.RemoteAddr, err), nil)
+			}
+			break
+		}
+		msg := message{}
+		if err = json.Unmarshal(b, &msg); err != nil {
+			self.Log(fmt.Sprintf("Web client %v sent %#v: %v", r.RemoteAddr, string(b), err), nil)
+			continue
+		}
+		if msg.Type == messageCommand {
+			self.command(msg.Text)
+		}
+	}
+	self.lock.Lock()
+	self.unregister(client)
+	self.lock.Unlock()
+	self.Log(fmt.Sprintf("Web client %v disconnected", r.RemoteAddr), nil)
+}
+
+func (self *Web) command(text string) {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		self.Log(err.Error(), nil)
+		return
+	}
+	chunk := common.Chunk{
+		Session: self.session,
+		Data:    []byte(text + "\n"),
+	}
+	if err = self.metrics.Call(client, common.ProxyTransmit, chunk, nil); err != nil {
+		self.broadcast(message{
+			Type: messageLog,
+			Text: err.Error(),
+		})
+		return
+	}
+	// the proxy marks chunks as transmitted when it sends them, but the metrics count them as transmitted here already
+	chunk.Transmitted = true
+	self.metrics.CountChunk(chunk)
+	self.lock.RLock()
+	masked := self.masked
+	self.lock.RUnlock()
+	// passwords must not reach the history
+	if !masked && text != "" {
+		if err = self.history.Push(text); err != nil {
+			self.Log(fmt.Sprintf("Unable to save history: %v", err), nil)
+		}
+	}
+}
+
+func (self *Web) ConsumerConsume(chunk common.Chunk, unused *struct{}) (err error) {
+	if self.session != "" && chunk.Session != self.session {
+		return
+	}
+	self.metrics.CountChunk(chunk)
+	self.lock.Lock()
+	parser, found := self.parsers[chunk.Session]
+	if !found {
+		parser = &common.ANSIParser{}
+		self.parsers[chunk.Session] = parser
+	}
+	parsed := parser.Parse(chunk.Data)
+	self.lock.Unlock()
+	// interrupts call scripts, which must not wait for the lock
+	text := self.Check(parsed)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	o := output{
+		chunk: chunk,
+		encoded: encode(message{
+			Type:    messageOutput,
+			Session: chunk.Session,
+			HTML:    toHTML(self.Apply(text)),
+		}),
+	}
+	for client := range self.clients {
+		if client.replaying {
+			client.pending = append(client.pending, o)
+		} else {
+			self.send(client, o.encoded)
+		}
+	}
+	return
+}
+
+// updateMasked asks the proxy about the echo state of our own session, since an empty session name can mean different
+// sessions depending on which ones exist.
+func (self *Web) updateMasked() {
+	client, err := mdnsrpc.LookupOne(common.Proxy)
+	if err != nil {
+		return
+	}
+	options := []common.TelnetOption{}
+	if err = self.metrics.Call(client, common.ProxyTelnetOptions, self.session, &options); err != nil {
+		return
+	}
+	masked := false
+	for _, option := range options {
+		if option.Code == common.TelnetOptionEcho {
+			masked = option.Remote
+		}
+	}
+	self.lock.Lock()
+	changed := masked != self.masked
+	self.masked = masked
+	self.lock.Unlock()
+	if changed {
+		self.broadcast(message{
+			Type:   messageEcho,
+			Masked: masked,
+		})
+	}
+}
+
+func (self *Web) SubscriberEcho(state common.EchoState, unused *struct{}) (err error) {
+	go self.updateMasked()
+	return
+}
+
+func (self *Web) SubscriberLog(s string, unused *struct{}) (err error) {
+	self.broadcast(message{
+		Type: messageLog,
+		Text: s,
+	})
+	return
+}
+
+func (self *Web) SubscriberTransmit(chunk common.Chunk, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Web) SubscriberReceive(chunk common.Chunk, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Web) SubscriberLine(line common.Line, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Web) SubscriberGMCP(msg common.GMCPMessage, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Web) SubscriberMSDP(variable common.MSDPVariable, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Web) SubscriberMSSP(status common.MSSPStatus, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Web) SubscriberConnected(event common.ConnectionEvent, unused *struct{}) (err error) {
+	return
+}
+
+func (self *Web) SubscriberDisconnected(event common.ConnectionEvent, unused *struct{}) (err error) {
+	return
+}
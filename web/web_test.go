@@ -0,0 +1,179 @@
+package web
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zond/moxie/common"
+)
+
+// consumed returns the HTML the page sends its clients when consuming data.
+func consumed(t *testing.T, web *Web, client *webClient, session string, data string) string {
+	if err := web.ConsumerConsume(common.Chunk{Session: session, Data: []byte(data)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	msg := message{}
+	if err := json.Unmarshal(<-client.out, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != messageOutput || msg.Session != session {
+		t.Fatalf("Wanted output of %v, got %+v", session, msg)
+	}
+	return msg.HTML
+}
+
+func TestConsumerConsume(t *testing.T) {
+	web := New()
+	client := &webClient{out: make(chan []byte, clientQueueSize)}
+	web.clients[client] = true
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"plain <text>\r\n", "plain &lt;text&gt;\n"},
+		{"\x1b[31mred\x1b[0m", `<span style="color:#aa0000">red</span>`},
+		{"\x1b[1;31mbright", `<span style="color:#ff5555;font-weight:bold">bright</span>`},
+		{"\x1b[", ""},
+		{"0m\x1b[38;5;196mcube\x1b[38;2;1;2;3mtrue", `<span style="color:#ff0000">cube</span><span style="color:#010203">true</span>`},
+		{"\x1b[0;7minverse\x1b[0m", `<span style="color:#000000;background-color:#aaaaaa">inverse</span>`},
+		{"split \xc3", "split "},
+		{"\xa5", "å"},
+		{"\x1b(Bcharset", "charset"},
+		{"\x1b]0;title\x07\x1b]2;other\x1b", ""},
+		{"\\shown", "shown"},
+	} {
+		if found := consumed(t, web, client, "default", test.input); found != test.expected {
+			t.Errorf("Wanted %#v for %#v, got %#v", test.expected, test.input, found)
+		}
+	}
+	// every session has its own style
+	if found := consumed(t, web, client, "other", "\x1b[31mred"); found != `<span style="color:#aa0000">red</span>` {
+		t.Fatalf("Got %#v", found)
+	}
+	if found := consumed(t, web, client, "default", "plain"); found != "plain" {
+		t.Fatalf("Got %#v", found)
+	}
+	if err := web.ConsumerHighlight(common.Highlight{Name: "orc", Pattern: "orc", Style: common.Style{Bold: true}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if found := consumed(t, web, client, "default", "an orc"); found != `an <span style="font-weight:bold">orc</span>` {
+		t.Fatalf("Got %#v", found)
+	}
+}
+
+func clientFrame(opcode byte, fin bool, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	result := []byte{first, 0x80 | byte(len(payload))}
+	mask := []byte{1, 2, 3, 4}
+	result = append(result, mask...)
+	for index, c := range payload {
+		result = append(result, c^mask[index%4])
+	}
+	return result
+}
+
+func TestWebsocket(t *testing.T) {
+	accepted := make(chan *websocket, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrade(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- ws
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: "+addr+"\r\nOrigin: http://"+addr+"\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Wanted accepted handshake, got %v %v", resp.Status, resp.Header)
+	}
+	ws := <-accepted
+	defer ws.Close()
+
+	// a fragmented message with a ping in the middle
+	conn.Write(clientFrame(opText, false, []byte("lo")))
+	conn.Write(clientFrame(opPing, true, []byte("hi")))
+	conn.Write(clientFrame(opContinuation, true, []byte("ok")))
+	message, err := ws.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != "look" {
+		t.Fatalf("Wanted look, got %#v", string(message))
+	}
+	pong := make([]byte, 4)
+	if _, err = io.ReadFull(reader, pong); err != nil {
+		t.Fatal(err)
+	}
+	if pong[0] != 0x80|opPong || string(pong[2:]) != "hi" {
+		t.Fatalf("Wanted pong, got %v", pong)
+	}
+
+	long := strings.Repeat("x", 300)
+	go ws.writeText([]byte(long))
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x80|opText || header[1] != 126 || binary.BigEndian.Uint16(header[2:]) != 300 {
+		t.Fatalf("Wanted text frame header, got %v", header)
+	}
+	payload := make([]byte, 300)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != long {
+		t.Fatalf("Wanted %v x, got %#v", len(long), string(payload))
+	}
+
+	conn.Write(clientFrame(opClose, true, nil))
+	if _, err = ws.readMessage(); err != io.EOF {
+		t.Fatalf("Wanted EOF, got %v", err)
+	}
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := upgrade(w, r); err == nil {
+			t.Errorf("Wanted refused origin")
+		}
+	}))
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL+"/ws", nil)
+	req.Header.Set("Origin", "http://evil.example.com")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Wanted forbidden, got %v", resp.Status)
+	}
+}
@@ -0,0 +1,186 @@
+package web
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	websocketGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	websocketMaxMessage = 1 << 20
+
+	opContinuation = 0
+	opText         = 1
+	opBinary       = 2
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+// websocket is the server side of a WebSocket connection, just enough of RFC 6455 for the browser client.
+type websocket struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeLock *sync.Mutex
+}
+
+func headerContains(header http.Header, key, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(key)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// upgrade takes over the connection of the request. Requests from pages served by other hosts are refused, so that
+// other sites can't play through the browsers of the people looking at them.
+func upgrade(w http.ResponseWriter, r *http.Request) (result *websocket, err error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "Not a WebSocket handshake", http.StatusBadRequest)
+		err = fmt.Errorf("Not a WebSocket handshake")
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, parseErr := url.Parse(origin)
+		if parseErr != nil || u.Host != r.Host {
+			http.Error(w, "Wrong origin", http.StatusForbidden)
+			err = fmt.Errorf("WebSocket from origin %#v refused", origin)
+			return
+		}
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Unable to hijack connection", http.StatusInternalServerError)
+		err = fmt.Errorf("Unable to hijack connection")
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	if _, err = fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %v\r\n\r\n", websocketAccept(key)); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+	result = &websocket{
+		conn:      conn,
+		reader:    rw.Reader,
+		writeLock: &sync.Mutex{},
+	}
+	return
+}
+
+func (self *websocket) writeFrame(opcode byte, payload []byte) (err error) {
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	if _, err = self.conn.Write(header); err != nil {
+		return
+	}
+	_, err = self.conn.Write(payload)
+	return
+}
+
+func (self *websocket) writeText(b []byte) error {
+	return self.writeFrame(opText, b)
+}
+
+// readMessage returns the next text or binary message, answering pings on the way. It returns io.EOF when the browser
+// closes the connection.
+func (self *websocket) readMessage() (result []byte, err error) {
+	header := make([]byte, 2)
+	for {
+		if _, err = io.ReadFull(self.reader, header); err != nil {
+			return
+		}
+		fin, opcode := header[0]&0x80 != 0, header[0]&0x0f
+		if header[1]&0x80 == 0 {
+			err = fmt.Errorf("Unmasked frame from client")
+			return
+		}
+		length := uint64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			extended := make([]byte, 2)
+			if _, err = io.ReadFull(self.reader, extended); err != nil {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(extended))
+		case 127:
+			extended := make([]byte, 8)
+			if _, err = io.ReadFull(self.reader, extended); err != nil {
+				return
+			}
+			length = binary.BigEndian.Uint64(extended)
+		}
+		if length+uint64(len(result)) > websocketMaxMessage {
+			err = fmt.Errorf("WebSocket message longer than %v bytes", websocketMaxMessage)
+			return
+		}
+		mask := make([]byte, 4)
+		if _, err = io.ReadFull(self.reader, mask); err != nil {
+			return
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(self.reader, payload); err != nil {
+			return
+		}
+		for index := range payload {
+			payload[index] ^= mask[index%4]
+		}
+		switch opcode {
+		case opClose:
+			self.writeFrame(opClose, nil)
+			err = io.EOF
+			return
+		case opPing:
+			if err = self.writeFrame(opPong, payload); err != nil {
+				return
+			}
+		case opPong:
+		case opText, opBinary, opContinuation:
+			result = append(result, payload...)
+			if fin {
+				return
+			}
+		default:
+			err = fmt.Errorf("Unknown WebSocket opcode %v", opcode)
+			return
+		}
+	}
+}
+
+func (self *websocket) Close() error {
+	return self.conn.Close()
+}